@@ -66,6 +66,7 @@ func addOne(ctx *Context, pipeline string, bundle string) error {
 }
 
 func (ctx *Context) Add(pipeline string, bundles ...string) error {
+	logAbout(pipeline, "")
 	log.Printf("==> Adding '%v' to '%s' pipeline", bundles, pipeline)
 	defer log.Printf("<== Adding complete.")
 
@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	// "gopkg.in/yaml.v2"
 )
 
@@ -59,17 +60,12 @@ func (ctx *Context) Bootstrap() error {
 	log.Printf("    Temp directory created at '%s'", ctx.BootstrapDir)
 
 	log.Printf(" |  Writing manager source files.")
-	if err := writeAsset("manager.go", ctx.BootstrapDir); err != nil {
-		return err
-	}
-	if err := writeAsset("Dockerfile", ctx.BootstrapDir); err != nil {
-		return err
-	}
-	if err := writeAsset("README.md", ctx.BootstrapDir); err != nil {
-		return err
-	}
-	if err := writeAsset("manager_test.go", ctx.BootstrapDir); err != nil {
-		return err
+	for _, asset := range bindata.AssetNames() {
+		if strings.HasPrefix(asset, "manager/") {
+			if err := writeAsset(strings.TrimPrefix(asset, "manager/"), ctx.BootstrapDir); err != nil {
+				return err
+			}
+		}
 	}
 	log.Printf("    Done")
 
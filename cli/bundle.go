@@ -56,7 +56,43 @@ CMD ["python", "{{ .Wrapper }}"]
 
 const wrapperTemplate = `
 import {{ .Plumber.Name }}
-from bottle import post, route, run, request, HTTPResponse
+import datetime
+import json
+import logging
+import os
+import time
+from bottle import post, route, run, request, BaseRequest, HTTPResponse
+
+# bottle refuses JSON bodies larger than this; match the manager's limit
+BaseRequest.MEMFILE_MAX = {{ if .Plumber.Limits }}{{ if .Plumber.Limits.Request }}{{ .Plumber.Limits.Request }}{{ else }}1048576{{ end }}{{ else }}1048576{{ end }}
+
+# with PLUMBER_LOG_FORMAT=json, every line is a JSON object with the
+# same fields the manager logs
+class JSONFormatter(logging.Formatter):
+    def format(self, record):
+        entry = {
+            'time': datetime.datetime.utcfromtimestamp(record.created).strftime('%Y-%m-%dT%H:%M:%S.%fZ'),
+            'level': record.levelname.lower(),
+            'msg': record.getMessage(),
+            'bundle': '{{ .Plumber.Name }}',
+        }
+        if os.environ.get('PLUMBER_PIPELINE'):
+            entry['pipeline'] = os.environ['PLUMBER_PIPELINE']
+        for field in ('request_id', 'duration_ms', 'error'):
+            if getattr(record, field, None) is not None:
+                entry[field] = getattr(record, field)
+        if record.exc_info and 'error' not in entry:
+            entry['error'] = self.formatException(record.exc_info)
+        return json.dumps(entry)
+
+__JSON_LOGS = os.environ.get('PLUMBER_LOG_FORMAT') == 'json'
+if __JSON_LOGS:
+    handler = logging.StreamHandler()
+    handler.setFormatter(JSONFormatter())
+    logging.getLogger().addHandler(handler)
+    logging.getLogger().setLevel(logging.INFO)
+else:
+    logging.basicConfig(level=logging.INFO, format='%(asctime)s {{ .Plumber.Name }} %(message)s')
 
 __INFO = {'bundle': '{{ .Plumber.Name }}',
   'inputs': {
@@ -71,8 +107,27 @@ __INFO = {'bundle': '{{ .Plumber.Name }}',
 def info():
     return __INFO
 
+# the manager sends every record with a request id, so we log it to
+# match our logs up with the manager's response
 @post('/')
 def index():
+    request_id = request.get_header('X-Request-ID', '-')
+    start = time.time()
+    fields = lambda **kw: dict(request_id=request_id, duration_ms=(time.time() - start) * 1000, **kw)
+    try:
+        output = enhance()
+    except HTTPResponse as e:
+        logging.warning("request %s failed with %d in %.1fms", request_id, e.status_code, (time.time() - start) * 1000,
+            extra=fields(error=str(e.body)))
+        raise
+    except Exception as e:
+        logging.exception("request %s failed in %.1fms", request_id, (time.time() - start) * 1000,
+            extra=fields(error=str(e)))
+        raise
+    logging.info("request %s took %.1fms", request_id, (time.time() - start) * 1000, extra=fields())
+    return output
+
+def enhance():
     data = request.json
 
     # validate input data
@@ -82,15 +137,16 @@ def index():
             status = 400
         )
 
-	# Instead of throwing errors when required fields are missing,
-	# maybe we just return the payload instead and add a note?
-    {{ range .Plumber.Inputs }}
+	# Optional inputs may be missing. With 'onMissingInputs: skip' in the
+	# bundle's policy, the manager never sends us records that are
+	# missing a required one.
+    {{ range .Plumber.Inputs }}{{ if not .Optional }}
     if not '{{ .Name }}' in data:
         raise HTTPResponse(
             body = "Missing required '{{ .Name }}' field in JSON data.",
             status = 400
         )
-    {{ end }}
+    {{ end }}{{ end }}
     # run the enhancer
     output = {{ .Plumber.Name }}.run(data)
 
@@ -103,14 +159,14 @@ def index():
         )
     {{ end }}
 
-	# Instead of assuming the output contains a superset of the input
-	# fields, we can add the input fields to the output here? It's a
-	# performance hit, but it means the output is *always* a superset
-	# of the input.
+	# The manager can guarantee the output is a superset of the input
+	# with a 'merge' policy in the pipeline's .pipeline.yml; it then only
+	# takes the declared outputs from our response.
 
     return output
 
-run(host='0.0.0.0', port=9800)
+# we log every request ourselves; bottle's own request lines aren't JSON
+run(host='0.0.0.0', port=9800, quiet=__JSON_LOGS)
 `
 
 func removeTempFile(f *os.File) {
@@ -136,6 +192,7 @@ func (ctx *Context) Bundle(bundlePath string) error {
 		return err
 	}
 	log.Printf("    %v", bundleConfig)
+	logAbout("", bundleConfig.Name)
 
 	log.Printf(" |  Making temp file for python wrapper")
 	wrapper, err := ioutil.TempFile(bundlePath, "plumber")
@@ -20,25 +20,157 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 type Field struct {
 	Name        string
 	Description string `yaml:",omitempty"`
 	Type        string
+	Optional    bool `yaml:",omitempty"` // only for inputs; the bundle can run without it
+}
+
+// How the manager should call a bundle. Durations are strings such as
+// "500ms" or "2s". The policy is passed to the manager as is.
+type Policy struct {
+	Timeout    string   `yaml:",omitempty" json:"timeout,omitempty"`
+	Retries    int      `yaml:",omitempty" json:"retries,omitempty"`
+	Backoff    string   `yaml:",omitempty" json:"backoff,omitempty"`
+	Idempotent bool     `yaml:",omitempty" json:"idempotent,omitempty"`
+	Breaker    *Breaker `yaml:",omitempty" json:"breaker,omitempty"`
+	// "skip" passes records that are missing a required input on to the
+	// next bundle instead of failing them
+	OnMissingInputs string `yaml:"onMissingInputs,omitempty" json:"onMissingInputs,omitempty"`
+}
+
+// The manager stops calling a bundle after `Failures` consecutive
+// failures and tries again after `Cooldown`.
+type Breaker struct {
+	Failures int    `json:"failures,omitempty"`
+	Cooldown string `json:"cooldown,omitempty"`
+}
+
+// Size limits in bytes for the records the manager sends and the
+// responses it accepts. The manager defaults to 1 MB.
+type Limits struct {
+	Request  int64 `yaml:",omitempty" json:"request,omitempty"`
+	Response int64 `yaml:",omitempty" json:"response,omitempty"`
+}
+
+// A bundle whose outputs only depend on its inputs can be cached by the
+// manager for `TTL`, a duration such as "1h". `Size` is the most results
+// the manager keeps; it defaults to 1000.
+type Cache struct {
+	TTL  string `yaml:"ttl" json:"ttl"`
+	Size int    `yaml:",omitempty" json:"size,omitempty"`
+}
+
+// How many records the manager lets in at once, either into the whole
+// pipeline or to a single bundle. Records over `MaxInFlight` wait in a
+// queue of at most `MaxQueue` records for up to `QueueTimeout`.
+type Admission struct {
+	MaxInFlight  int    `yaml:"maxInFlight,omitempty" json:"maxInFlight,omitempty"`
+	MaxQueue     int    `yaml:"maxQueue,omitempty" json:"maxQueue,omitempty"`
+	QueueTimeout string `yaml:"queueTimeout,omitempty" json:"queueTimeout,omitempty"`
+}
+
+// When a bundle runs several replicas, the manager spreads records over
+// them by `Strategy`, "round-robin" (the default) or "least-connections",
+// and stops using a replica for `Cooldown` after `Failures` consecutive
+// failures.
+type Balance struct {
+	Strategy string `yaml:",omitempty" json:"strategy,omitempty"`
+	Failures int    `yaml:",omitempty" json:"failures,omitempty"`
+	Cooldown string `yaml:",omitempty" json:"cooldown,omitempty"`
+}
+
+// The manager mirrors a `Sample` of the records sent to a bundle to a
+// candidate version of it at `URL`, and compares their outputs. The
+// candidate's output never reaches the caller.
+type Shadow struct {
+	URL    string  `yaml:"url" json:"url"`
+	Sample float64 `yaml:",omitempty" json:"sample,omitempty"`
 }
 
 type Bundle struct {
-	Language string
-	Name     string
-	Inputs   []Field  `yaml:",flow"`
-	Outputs  []Field  `yaml:",flow"`
-	Env      []string `yaml:",flow,omitempty"`
-	Install  []string `yaml:",flow,omitempty"`
+	Language  string
+	Name      string
+	Inputs    []Field    `yaml:",flow"`
+	Outputs   []Field    `yaml:",flow"`
+	Env       []string   `yaml:",flow,omitempty"`
+	Install   []string   `yaml:",flow,omitempty"`
+	Policy    *Policy    `yaml:",omitempty"`
+	Limits    *Limits    `yaml:",omitempty"`
+	Cache     *Cache     `yaml:",omitempty"`
+	Admission *Admission `yaml:",omitempty"`
+	Replicas  int        `yaml:",omitempty"` // how many containers to run locally; 1 if unset
+	Balance   *Balance   `yaml:",omitempty"`
+	Shadow    *Shadow    `yaml:",omitempty"`
+}
+
+// Settings for a whole pipeline, rather than a single bundle. These
+// are kept in `.pipeline.yml` in the pipeline's directory.
+type Pipeline struct {
+	Merge     *Merge     `yaml:",omitempty"`
+	Limits    *Limits    `yaml:",omitempty"`
+	Admission *Admission `yaml:",omitempty"`
+	Record    *Record    `yaml:",omitempty"`
+	Auth      *Auth      `yaml:",omitempty"`
+	Admin     *Auth      `yaml:",omitempty"` // who can use the manager's admin API
+	TLS       *TLS       `yaml:"tls,omitempty"`
+	Lineage   bool       `yaml:",omitempty"` // add `_plumber` to every record, saying where its fields came from
+	// how the manager connects to bundles that serve HTTPS
+	EnhancerTLS *EnhancerTLS `yaml:"enhancerTLS,omitempty"`
+}
+
+// Callers must send one of `APIKeys` in the X-API-Key header, or one of
+// `Tokens` as a bearer token, to use the pipeline.
+type Auth struct {
+	APIKeys []string `yaml:"apiKeys,omitempty" json:"apiKeys,omitempty"`
+	Tokens  []string `yaml:",omitempty" json:"tokens,omitempty"`
+}
+
+// The manager serves HTTPS with this certificate and key. Relative
+// paths are relative to the pipeline's directory.
+type TLS struct {
+	Cert string
+	Key  string
+}
+
+// The manager trusts only certificates signed by `CA`, if it's set, when
+// it connects to bundles over HTTPS, and presents `Cert` and `Key` to
+// bundles that require mutual TLS. Relative paths are relative to the
+// pipeline's directory.
+type EnhancerTLS struct {
+	CA   string `yaml:",omitempty" json:"ca,omitempty"`
+	Cert string `yaml:",omitempty" json:"cert,omitempty"`
+	Key  string `yaml:",omitempty" json:"key,omitempty"`
+}
+
+// The local manager records a `Sample` of the records sent to the
+// pipeline, and the responses it gives, for `plumber replay`. It keeps
+// them in `Dir`, which is set when the pipeline starts.
+type Record struct {
+	Dir    string  `yaml:"-" json:"dir"`
+	Sample float64 `yaml:",omitempty" json:"sample,omitempty"`
+}
+
+// How the manager merges the outputs of each bundle into the record.
+// `Conflicts` is one of "error", "first-wins" or "last-wins". With
+// `Project`, each bundle is only sent the inputs it declares.
+type Merge struct {
+	Conflicts string `yaml:",omitempty" json:"conflicts,omitempty"`
+	Strict    bool   `yaml:",omitempty" json:"strict,omitempty"`
+	Project   bool   `yaml:",omitempty" json:"project,omitempty"`
 }
 
 const bundleConfig = ".plumb.yml"
 
+const pipelineConfig = ".pipeline.yml"
+
 // Parse a `.plumb.yml` in the given directory
 func ParseBundleFromDir(path string) (*Bundle, error) {
 	return ParseBundle(fmt.Sprintf("%s/%s", path, bundleConfig))
@@ -86,5 +218,206 @@ func ParseBundle(path string) (*Bundle, error) {
 		}
 	}
 
+	if ctx.Policy != nil {
+		if err := checkPolicy(ctx.Policy); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkLimits(ctx.Limits); err != nil {
+		return nil, err
+	}
+
+	if err := checkAdmission(ctx.Admission); err != nil {
+		return nil, err
+	}
+
+	if ctx.Replicas < 0 {
+		return nil, errors.New("The number of 'replicas' cannot be negative.")
+	}
+
+	if ctx.Balance != nil {
+		switch ctx.Balance.Strategy {
+		case "", "round-robin", "least-connections":
+		default:
+			return nil, errors.New("The balance 'strategy' must be 'round-robin' or 'least-connections'.")
+		}
+		if ctx.Balance.Failures < 0 {
+			return nil, errors.New("The balance 'failures' cannot be negative.")
+		}
+		if err := checkDuration("balance", "cooldown", ctx.Balance.Cooldown); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.Shadow != nil {
+		if u, err := url.Parse(ctx.Shadow.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.New("The shadow needs an http or https 'url'.")
+		}
+		if ctx.Shadow.Sample < 0 || ctx.Shadow.Sample > 1 {
+			return nil, errors.New("The shadow 'sample' must be between 0 and 1.")
+		}
+	}
+
+	if ctx.Cache != nil {
+		if d, err := time.ParseDuration(ctx.Cache.TTL); err != nil || d <= 0 {
+			return nil, errors.New("The cache 'ttl' must be a duration such as '1h'.")
+		}
+		if ctx.Cache.Size < 0 {
+			return nil, errors.New("The cache 'size' cannot be negative.")
+		}
+	}
+
 	return &ctx, nil
 }
+
+// Parse the `.pipeline.yml` in the given pipeline directory. A pipeline
+// without one uses the defaults.
+func ParsePipelineFromDir(path string) (*Pipeline, error) {
+	config := Pipeline{}
+
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", path, pipelineConfig))
+	if os.IsNotExist(err) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(bytes, &config); err != nil {
+		return nil, err
+	}
+
+	if config.Merge != nil {
+		switch config.Merge.Conflicts {
+		case "", "error", "first-wins", "last-wins":
+		default:
+			return nil, errors.New("The merge 'conflicts' must be one of 'error', 'first-wins' or 'last-wins'.")
+		}
+	}
+
+	if err := checkLimits(config.Limits); err != nil {
+		return nil, err
+	}
+
+	if err := checkAdmission(config.Admission); err != nil {
+		return nil, err
+	}
+
+	if config.Record != nil && (config.Record.Sample < 0 || config.Record.Sample > 1) {
+		return nil, errors.New("The recording 'sample' must be between 0 and 1.")
+	}
+
+	if err := checkAuth("auth", config.Auth); err != nil {
+		return nil, err
+	}
+	if err := checkAuth("admin", config.Admin); err != nil {
+		return nil, err
+	}
+	if config.Admin != nil && len(config.Admin.APIKeys) == 0 && len(config.Admin.Tokens) == 0 {
+		return nil, errors.New("The 'admin' API needs an API key or token.")
+	}
+
+	if config.TLS != nil {
+		if config.TLS.Cert == "" || config.TLS.Key == "" {
+			return nil, errors.New("The 'tls' settings need both a 'cert' and a 'key'.")
+		}
+		resolvePaths(path, &config.TLS.Cert, &config.TLS.Key)
+	}
+
+	if err := checkEnhancerTLS(path, config.EnhancerTLS); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Makes relative paths relative to `dir`. Empty paths are left alone.
+func resolvePaths(dir string, files ...*string) {
+	for _, file := range files {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+}
+
+func checkEnhancerTLS(path string, enhancerTLS *EnhancerTLS) error {
+	if enhancerTLS == nil {
+		return nil
+	}
+	if enhancerTLS.CA == "" && enhancerTLS.Cert == "" {
+		return errors.New("The 'enhancerTLS' settings need a 'ca', or a 'cert' and a 'key'.")
+	}
+	if (enhancerTLS.Cert == "") != (enhancerTLS.Key == "") {
+		return errors.New("The 'enhancerTLS' settings need both a 'cert' and a 'key' for a client certificate.")
+	}
+	resolvePaths(path, &enhancerTLS.CA, &enhancerTLS.Cert, &enhancerTLS.Key)
+	return nil
+}
+
+func checkAuth(name string, auth *Auth) error {
+	if auth == nil {
+		return nil
+	}
+	for _, secret := range append(append([]string{}, auth.APIKeys...), auth.Tokens...) {
+		if secret == "" {
+			return fmt.Errorf("The '%s' API keys and tokens cannot be empty.", name)
+		}
+	}
+	return nil
+}
+
+func checkLimits(limits *Limits) error {
+	if limits != nil && (limits.Request < 0 || limits.Response < 0) {
+		return errors.New("The 'limits' cannot be negative.")
+	}
+	return nil
+}
+
+func checkAdmission(admission *Admission) error {
+	if admission == nil {
+		return nil
+	}
+	if admission.MaxInFlight < 0 || admission.MaxQueue < 0 {
+		return errors.New("The admission 'maxInFlight' and 'maxQueue' cannot be negative.")
+	}
+	if admission.QueueTimeout != "" {
+		if d, err := time.ParseDuration(admission.QueueTimeout); err != nil || d < 0 {
+			return errors.New("The admission 'queueTimeout' must be a duration such as '5s'.")
+		}
+	}
+	return nil
+}
+
+// Checks a duration in the `section` of the settings.
+func checkDuration(section, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		return fmt.Errorf("The %s '%s' must be a duration such as '2s'.", section, name)
+	}
+	return nil
+}
+
+func checkPolicy(policy *Policy) error {
+	if err := checkDuration("policy", "timeout", policy.Timeout); err != nil {
+		return err
+	}
+	if err := checkDuration("policy", "backoff", policy.Backoff); err != nil {
+		return err
+	}
+	if policy.Retries < 0 {
+		return errors.New("The policy 'retries' cannot be negative.")
+	}
+	if policy.Retries > 0 && !policy.Idempotent {
+		return errors.New("Only 'idempotent' bundles can be retried.")
+	}
+	if policy.OnMissingInputs != "" && policy.OnMissingInputs != "fail" && policy.OnMissingInputs != "skip" {
+		return fmt.Errorf("The policy 'onMissingInputs' must be 'fail' or 'skip', not '%s'.", policy.OnMissingInputs)
+	}
+	if policy.Breaker != nil {
+		if err := checkDuration("policy", "cooldown", policy.Breaker.Cooldown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
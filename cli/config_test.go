@@ -20,7 +20,9 @@ import (
 	"github.com/qadium/plumber/cli"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -77,6 +79,117 @@ outputs:
 inputs:
   - name: a`
 
+// bundle with a policy for the manager
+const policyBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+    type: string
+outputs:
+  - name: b
+    type: string
+policy:
+  timeout: 2s
+  retries: 3
+  backoff: 50ms
+  idempotent: true
+  breaker:
+    failures: 5
+    cooldown: 30s`
+
+// bundle that retries, but isn't idempotent
+const retryBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+policy:
+  retries: 3`
+
+// bundle with a timeout that isn't a duration
+const badTimeoutBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+policy:
+  timeout: forever`
+
+// bundle that is skipped when its required input is missing
+const skipBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+  - name: c
+    optional: true
+outputs:
+  - name: b
+policy:
+  onMissingInputs: skip`
+
+const badSkipBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+policy:
+  onMissingInputs: ignore`
+
+// bundle with several replicas
+const replicaBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+replicas: 3
+balance:
+  strategy: least-connections
+  failures: 2
+  cooldown: 5s`
+
+const badBalanceBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+replicas: 3
+balance:
+  strategy: random`
+
+// bundle with a candidate version
+const shadowBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+shadow:
+  url: http://candidate:9800
+  sample: 0.25`
+
+const badShadowBundle = `
+language: python
+name: foobar
+inputs:
+  - name: a
+outputs:
+  - name: b
+shadow:
+  sample: 0.25`
+
 func writeBundle(t *testing.T, bundle string) string {
 	configFile, err := ioutil.TempFile("", "plumberTest")
 	if err != nil {
@@ -164,6 +277,76 @@ func TestParseOptBundle(t *testing.T) {
 	parseBundle(t, ctx, optBundle)
 }
 
+func TestParsePolicyBundle(t *testing.T) {
+	ctx := &cli.Bundle{
+		Language: "python",
+		Name:     "foobar",
+		Inputs:   []cli.Field{cli.Field{Name: "a", Type: "string"}},
+		Outputs:  []cli.Field{cli.Field{Name: "b", Type: "string"}},
+		Policy: &cli.Policy{
+			Timeout:    "2s",
+			Retries:    3,
+			Backoff:    "50ms",
+			Idempotent: true,
+			Breaker:    &cli.Breaker{Failures: 5, Cooldown: "30s"},
+		},
+	}
+	parseBundle(t, ctx, policyBundle)
+}
+
+func TestParseSkipBundle(t *testing.T) {
+	ctx := &cli.Bundle{
+		Language: "python",
+		Name:     "foobar",
+		Inputs:   []cli.Field{cli.Field{Name: "a"}, cli.Field{Name: "c", Optional: true}},
+		Outputs:  []cli.Field{cli.Field{Name: "b"}},
+		Policy:   &cli.Policy{OnMissingInputs: "skip"},
+	}
+	parseBundle(t, ctx, skipBundle)
+	parseBundle(t, nil, badSkipBundle)
+}
+
+func TestParseReplicaBundle(t *testing.T) {
+	ctx := &cli.Bundle{
+		Language: "python",
+		Name:     "foobar",
+		Inputs:   []cli.Field{cli.Field{Name: "a"}},
+		Outputs:  []cli.Field{cli.Field{Name: "b"}},
+		Replicas: 3,
+		Balance:  &cli.Balance{Strategy: "least-connections", Failures: 2, Cooldown: "5s"},
+	}
+	parseBundle(t, ctx, replicaBundle)
+	parseBundle(t, nil, badBalanceBundle)
+
+	// the error points at the balance section, not the policy
+	configFile := writeBundle(t, strings.Replace(replicaBundle, "cooldown: 5s", "cooldown: soon", 1))
+	defer os.RemoveAll(configFile)
+	_, err := cli.ParseBundle(configFile)
+	if err == nil || err.Error() != "The balance 'cooldown' must be a duration such as '2s'." {
+		t.Errorf("Got unexpected error '%v' for a bad cooldown", err)
+	}
+}
+
+func TestParseShadowBundle(t *testing.T) {
+	ctx := &cli.Bundle{
+		Language: "python",
+		Name:     "foobar",
+		Inputs:   []cli.Field{cli.Field{Name: "a"}},
+		Outputs:  []cli.Field{cli.Field{Name: "b"}},
+		Shadow:   &cli.Shadow{URL: "http://candidate:9800", Sample: 0.25},
+	}
+	parseBundle(t, ctx, shadowBundle)
+	parseBundle(t, nil, badShadowBundle)
+}
+
+func TestParseRetryNotIdempotent(t *testing.T) {
+	parseBundle(t, nil, retryBundle)
+}
+
+func TestParseBadTimeout(t *testing.T) {
+	parseBundle(t, nil, badTimeoutBundle)
+}
+
 func TestParseMissingFields(t *testing.T) {
 	parseBundle(t, nil, missingFields)
 }
@@ -186,6 +369,41 @@ name: hello
 inputs:
   - name: a`)
 }
+func TestParseNegativeLimits(t *testing.T) {
+	parseBundle(t, nil, `language: python
+name: hello
+inputs:
+  - name: a
+outputs:
+  - name: b
+limits:
+  request: -1`)
+}
+
+func TestParseCache(t *testing.T) {
+	bundle := `language: python
+name: hello
+inputs:
+  - name: a
+outputs:
+  - name: b
+`
+	parseBundle(t, &cli.Bundle{
+		Language: "python",
+		Name:     "hello",
+		Inputs:   []cli.Field{cli.Field{Name: "a"}},
+		Outputs:  []cli.Field{cli.Field{Name: "b"}},
+		Cache:    &cli.Cache{TTL: "1h", Size: 10},
+	}, bundle+`cache:
+  ttl: 1h
+  size: 10`)
+	parseBundle(t, nil, bundle+`cache:
+  size: 10`)
+	parseBundle(t, nil, bundle+`cache:
+  ttl: 1h
+  size: -1`)
+}
+
 func TestParseMissingName(t *testing.T) {
 	parseBundle(t, nil, `language: python`)
 }
@@ -237,3 +455,182 @@ func TestParseBundleFromDir(t *testing.T) {
 		t.Errorf("Got '%v', expected '%v'", ctx, expected)
 	}
 }
+
+// if the expected pipeline is nil, then we'll check if an error is thrown
+func parsePipeline(t *testing.T, expected *cli.Pipeline, pipeline string) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Errorf("Could not make temp dir; got error '%v'", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Had an issue removing the temp directory, '%v'", err)
+		}
+	}()
+
+	if pipeline != "" {
+		filename := fmt.Sprintf("%s/.pipeline.yml", tempDir)
+		if err := ioutil.WriteFile(filename, []byte(pipeline), 0644); err != nil {
+			t.Errorf("Could not write .pipeline.yml; got error '%v'", err)
+		}
+	}
+
+	ctx, err := cli.ParsePipelineFromDir(tempDir)
+	if expected == nil {
+		if err == nil {
+			t.Errorf("Expected an error, but got '%v'", ctx)
+		}
+	} else {
+		if err != nil {
+			t.Errorf("Had an issue parsing the pipeline file, '%v'", err)
+		}
+		if !reflect.DeepEqual(ctx, expected) {
+			t.Errorf("Got '%v', expected '%v'", ctx, expected)
+		}
+	}
+}
+
+func TestParsePipelineFromDir(t *testing.T) {
+	// no file means the defaults
+	parsePipeline(t, &cli.Pipeline{}, "")
+
+	parsePipeline(t, &cli.Pipeline{Merge: &cli.Merge{Conflicts: "error", Strict: true, Project: true}}, `
+merge:
+  conflicts: error
+  strict: true
+  project: true
+`)
+
+	parsePipeline(t, &cli.Pipeline{Limits: &cli.Limits{Request: 4194304}}, `
+limits:
+  request: 4194304
+`)
+
+	parsePipeline(t, nil, `
+limits:
+  response: -1
+`)
+
+	parsePipeline(t, &cli.Pipeline{Admission: &cli.Admission{MaxInFlight: 64, MaxQueue: 256, QueueTimeout: "2s"}}, `
+admission:
+  maxInFlight: 64
+  maxQueue: 256
+  queueTimeout: 2s
+`)
+
+	parsePipeline(t, nil, `
+admission:
+  queueTimeout: soon
+`)
+
+	parsePipeline(t, nil, `
+merge:
+  conflicts: sometimes
+`)
+
+	parsePipeline(t, &cli.Pipeline{Record: &cli.Record{Sample: 0.1}}, `
+record:
+  sample: 0.1
+`)
+
+	parsePipeline(t, nil, `
+record:
+  sample: 2
+`)
+
+	parsePipeline(t, &cli.Pipeline{Auth: &cli.Auth{APIKeys: []string{"key"}, Tokens: []string{"token"}}}, `
+auth:
+  apiKeys: [key]
+  tokens: [token]
+`)
+
+	parsePipeline(t, nil, `
+auth:
+  tokens: [""]
+`)
+
+	parsePipeline(t, &cli.Pipeline{Admin: &cli.Auth{Tokens: []string{"admin"}}}, `
+admin:
+  tokens: [admin]
+`)
+
+	parsePipeline(t, nil, `
+admin:
+  apiKeys: []
+`)
+
+	parsePipeline(t, &cli.Pipeline{Lineage: true}, `
+lineage: true
+`)
+
+	parsePipeline(t, &cli.Pipeline{TLS: &cli.TLS{Cert: "/certs/cert.pem", Key: "/certs/key.pem"}}, `
+tls:
+  cert: /certs/cert.pem
+  key: /certs/key.pem
+`)
+
+	parsePipeline(t, nil, `
+tls:
+  cert: /certs/cert.pem
+`)
+
+	parsePipeline(t, &cli.Pipeline{EnhancerTLS: &cli.EnhancerTLS{CA: "/certs/ca.pem", Cert: "/certs/client.pem", Key: "/certs/client-key.pem"}}, `
+enhancerTLS:
+  ca: /certs/ca.pem
+  cert: /certs/client.pem
+  key: /certs/client-key.pem
+`)
+
+	parsePipeline(t, &cli.Pipeline{EnhancerTLS: &cli.EnhancerTLS{CA: "/certs/ca.pem"}}, `
+enhancerTLS:
+  ca: /certs/ca.pem
+`)
+
+	parsePipeline(t, nil, `
+enhancerTLS:
+  key: /certs/client-key.pem
+`)
+
+	parsePipeline(t, nil, `
+enhancerTLS: {}
+`)
+}
+
+// Test that relative TLS files are found in the pipeline's directory.
+func TestParsePipelineTLSRelative(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/.pipeline.yml", tempDir), []byte("tls:\n  cert: cert.pem\n  key: key.pem\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := cli.ParsePipelineFromDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline.TLS.Cert != filepath.Join(tempDir, "cert.pem") || pipeline.TLS.Key != filepath.Join(tempDir, "key.pem") {
+		t.Errorf("Got '%v', expected files in '%s'", pipeline.TLS, tempDir)
+	}
+}
+
+// Test that relative enhancer TLS files are found in the pipeline's
+// directory.
+func TestParsePipelineEnhancerTLSRelative(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/.pipeline.yml", tempDir), []byte("enhancerTLS:\n  ca: ca.pem\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := cli.ParsePipelineFromDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pipeline.EnhancerTLS != (cli.EnhancerTLS{CA: filepath.Join(tempDir, "ca.pem")}) {
+		t.Errorf("Got '%v', expected files in '%s'", pipeline.EnhancerTLS, tempDir)
+	}
+}
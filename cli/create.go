@@ -23,6 +23,7 @@ import (
 )
 
 func (ctx *Context) Create(name string) error {
+	logAbout(name, "")
 	// creates a pipeline by initializing a git repo at ~/.plumb/<NAME>
 	log.Printf("==> Creating '%s' pipeline", name)
 	defer log.Printf("<== Creation complete.")
@@ -0,0 +1,245 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// The manager appends records that fail to this file in the
+// pipeline's dead letter directory.
+const deadLetterFile = "dead-letters.jsonl"
+
+// The manager names the dead letter it stored a record as in this
+// header of its response.
+const deadLetterHeader = "X-Plumber-Dead-Letter"
+
+// A record that failed in a pipeline. This must match the `deadLetter`
+// struct in the manager.
+type DeadLetter struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Pipeline string          `json:"pipeline,omitempty"`
+	Bundle   string          `json:"bundle,omitempty"`
+	Status   int             `json:"status"`
+	Error    string          `json:"error"`
+	Record   json.RawMessage `json:"record"`
+	Partial  json.RawMessage `json:"partial,omitempty"`
+}
+
+func readDeadLetters(filename string) ([]DeadLetter, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	letters := []DeadLetter{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+func appendDeadLetters(filename string, letters []DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Get the dead letters for a pipeline, oldest first.
+func (ctx *Context) DeadLetters(pipeline string) ([]DeadLetter, error) {
+	logAbout(pipeline, "")
+	if _, err := ctx.GetPipeline(pipeline); err != nil {
+		return nil, err
+	}
+	return readDeadLetters(fmt.Sprintf("%s/%s", ctx.DeadLetterPath(pipeline), deadLetterFile))
+}
+
+// Print a summary of every dead letter in the pipeline.
+func (ctx *Context) ListDeadLetters(pipeline string) error {
+	letters, err := ctx.DeadLetters(pipeline)
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		fmt.Printf("%s\t%s\t%s\t%d\t%s\n", letter.ID, letter.Time.Format(time.RFC3339), letter.Bundle, letter.Status, letter.Error)
+	}
+	return nil
+}
+
+// Print a single dead letter.
+func (ctx *Context) ShowDeadLetter(pipeline, id string) error {
+	letters, err := ctx.DeadLetters(pipeline)
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		if letter.ID == id {
+			bytes, err := json.MarshalIndent(letter, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(bytes))
+			return nil
+		}
+	}
+	return fmt.Errorf("No dead letter with id '%s'.", id)
+}
+
+// Appends the contents of `from` to `to` and removes `from`.
+func restoreDeadLetters(from, to string) error {
+	contents, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(to, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Send dead letters through the pipeline again. If `ids` is empty,
+// every dead letter is replayed. A letter is removed once the pipeline
+// processes its record, or once the manager says it stored the record
+// as a new dead letter. Any other response, or no response at all,
+// leaves the letter where it was.
+func (ctx *Context) ReplayDeadLetters(pipeline, managerUrl string, ids ...string) error {
+	logAbout(pipeline, "")
+	log.Printf("==> Replaying dead letters for '%s' pipeline", pipeline)
+	defer log.Printf("<== Replay complete.")
+
+	client, err := ctx.newManagerClient(pipeline, managerUrl, time.Minute)
+	if err != nil {
+		return err
+	}
+
+	// move the dead letters out of the way, so the manager can keep
+	// appending new ones while we replay
+	log.Printf(" |  Collecting dead letters.")
+	filename := fmt.Sprintf("%s/%s", ctx.DeadLetterPath(pipeline), deadLetterFile)
+	replayFilename := fmt.Sprintf("%s.replay-%d", filename, time.Now().UnixNano())
+	if err := os.Rename(filename, replayFilename); err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("    No dead letters.")
+			return nil
+		}
+		return err
+	}
+	letters, err := readDeadLetters(replayFilename)
+	if err != nil {
+		// put them back as they were
+		if restoreErr := restoreDeadLetters(replayFilename, filename); restoreErr != nil {
+			return fmt.Errorf("%v; the dead letters are left in '%s': %v", err, replayFilename, restoreErr)
+		}
+		return err
+	}
+
+	selected := make(map[string]bool)
+	for _, id := range ids {
+		selected[id] = true
+	}
+	replay := []DeadLetter{}
+	keep := []DeadLetter{}
+	for _, letter := range letters {
+		if len(ids) == 0 || selected[letter.ID] {
+			replay = append(replay, letter)
+		} else {
+			keep = append(keep, letter)
+		}
+	}
+	log.Printf("    Replaying %d of %d.", len(replay), len(letters))
+
+	// the letters we keep go back where the manager, and `plumber dlq`,
+	// will find them
+	finish := func(keep []DeadLetter) error {
+		if err := appendDeadLetters(filename, keep); err != nil {
+			return fmt.Errorf("%v; the dead letters are left in '%s'", err, replayFilename)
+		}
+		return os.Remove(replayFilename)
+	}
+
+	log.Printf(" |  Sending records to '%s'.", client.url)
+	for i, letter := range replay {
+		req, err := client.request("POST", "", bytes.NewReader(letter.Record))
+		if err != nil {
+			if finishErr := finish(append(keep, replay[i:]...)); finishErr != nil {
+				return finishErr
+			}
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			// the manager never saw it, so we hang on to it
+			log.Printf("    %s: %v", letter.ID, err)
+			keep = append(keep, letter)
+			continue
+		}
+		ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+		if !ok && resp.Header.Get(deadLetterHeader) == "" {
+			log.Printf("    %s: %s; keeping it", letter.ID, resp.Status)
+			keep = append(keep, letter)
+		} else {
+			log.Printf("    %s: %s", letter.ID, resp.Status)
+		}
+		resp.Body.Close()
+	}
+	return finish(keep)
+}
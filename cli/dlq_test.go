@@ -0,0 +1,174 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/qadium/plumber/cli"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testDeadLetters = `{"id":"a-1","time":"2015-07-01T00:00:00Z","pipeline":"dlq","bundle":"b","status":502,"error":"oops","record":{"x":1}}
+{"id":"a-2","time":"2015-07-01T00:00:01Z","pipeline":"dlq","bundle":"b","status":502,"error":"oops","record":{"x":2}}
+
+{"id":"a-3","time":"2015-07-01T00:00:02Z","pipeline":"dlq","bundle":"c","status":422,"error":"bad","record":{"x":3}}
+`
+
+func writeTestDeadLetters(t *testing.T, ctx *cli.Context, pipeline string) string {
+	dlq := ctx.DeadLetterPath(pipeline)
+	if err := os.MkdirAll(dlq, 0755); err != nil {
+		t.Fatalf("Could not make dead letter directory; got error '%v'", err)
+	}
+	filename := fmt.Sprintf("%s/dead-letters.jsonl", dlq)
+	if err := ioutil.WriteFile(filename, []byte(testDeadLetters), 0644); err != nil {
+		t.Fatalf("Could not write dead letters; got error '%v'", err)
+	}
+	return filename
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	writeTestDeadLetters(t, ctx, "dlq")
+
+	letters, err := ctx.DeadLetters("dlq")
+	if err != nil {
+		t.Fatalf("DeadLetters: got unexpected error '%v'", err)
+	}
+	if len(letters) != 3 || letters[2].ID != "a-3" || letters[2].Bundle != "c" ||
+		letters[2].Status != 422 || string(letters[2].Record) != `{"x":3}` {
+		t.Errorf("DeadLetters: got '%v'", letters)
+	}
+
+	if err := ctx.ShowDeadLetter("dlq", "nope"); err == nil {
+		t.Error("DeadLetters: expected an error showing a missing dead letter")
+	}
+
+	if _, err := ctx.DeadLetters("missing"); err == nil {
+		t.Error("DeadLetters: expected an error for a missing pipeline")
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	filename := writeTestDeadLetters(t, ctx, "dlq")
+
+	received := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		received = append(received, buf.String())
+	}))
+	defer ts.Close()
+
+	if err := ctx.ReplayDeadLetters("dlq", ts.URL, "a-1", "a-3"); err != nil {
+		t.Fatalf("ReplayDeadLetters: got unexpected error '%v'", err)
+	}
+	if fmt.Sprint(received) != `[{"x":1} {"x":3}]` {
+		t.Errorf("ReplayDeadLetters: manager received '%v'", received)
+	}
+
+	// only the dead letter we didn't replay is left
+	letters, err := ctx.DeadLetters("dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "a-2" {
+		t.Errorf("ReplayDeadLetters: '%v' were left over", letters)
+	}
+	files, _ := ioutil.ReadDir(ctx.DeadLetterPath("dlq"))
+	if len(files) != 1 || files[0].Name() != "dead-letters.jsonl" {
+		t.Errorf("ReplayDeadLetters: left files '%v' behind in '%s'", files, filename)
+	}
+
+	// if the manager is down, we keep the dead letters
+	ts.Close()
+	if err := ctx.ReplayDeadLetters("dlq", ts.URL); err != nil {
+		t.Fatalf("ReplayDeadLetters: got unexpected error '%v'", err)
+	}
+	letters, _ = ctx.DeadLetters("dlq")
+	if len(letters) != 1 {
+		t.Errorf("ReplayDeadLetters: lost dead letters when the manager was down")
+	}
+}
+
+func TestReplayDeadLettersKeepsRejectedRecords(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	writeTestDeadLetters(t, ctx, "dlq")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch buf.String() {
+		case `{"x":1}`:
+			// the response was too large, which no bundle is blamed
+			// for, but the manager stored it again all the same
+			w.Header().Set("X-Plumber-Dead-Letter", "b-1")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(`{"error":{"message":"The response is too large."}}`))
+		case `{"x":2}`:
+			// turned away before it reached the pipeline
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Too many records in flight."}}`))
+		default:
+			// failed in a bundle, but the manager didn't store it
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error":{"bundle":"c","message":"bad"}}`))
+		}
+	}))
+	defer ts.Close()
+
+	if err := ctx.ReplayDeadLetters("dlq", ts.URL); err != nil {
+		t.Fatalf("ReplayDeadLetters: got unexpected error '%v'", err)
+	}
+	letters, err := ctx.DeadLetters("dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].ID != "a-2" || letters[1].ID != "a-3" {
+		t.Errorf("ReplayDeadLetters: kept '%v', expected a-2 and a-3", letters)
+	}
+}
+
+func TestReplayDeadLettersRestoresUnreadableLetters(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	filename := writeTestDeadLetters(t, ctx, "dlq")
+	broken := testDeadLetters + "not json\n"
+	if err := ioutil.WriteFile(filename, []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.ReplayDeadLetters("dlq", "http://127.0.0.1:1"); err == nil {
+		t.Fatal("ReplayDeadLetters: expected an error for unreadable dead letters")
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil || string(contents) != broken {
+		t.Errorf("ReplayDeadLetters: dead letters were not put back; got '%s' (%v)", contents, err)
+	}
+	files, _ := ioutil.ReadDir(ctx.DeadLetterPath("dlq"))
+	if len(files) != 1 {
+		t.Errorf("ReplayDeadLetters: left files '%v' behind", files)
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The CLI, the manager and the bundle wrapper all read their log format
+// from this environment variable; `plumber start` passes it on.
+const LogFormatEnv = "PLUMBER_LOG_FORMAT"
+
+// Bundles are told which pipeline they're in, so their logs can say so.
+const pipelineEnv = "PLUMBER_PIPELINE"
+
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// A JSON log line. This must have the same fields as the manager's
+// `logEntry` and the wrapper's log lines.
+type logEntry struct {
+	Time      string   `json:"time"`
+	Level     string   `json:"level"`
+	Message   string   `json:"msg"`
+	Pipeline  string   `json:"pipeline,omitempty"`
+	Bundle    string   `json:"bundle,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+	Duration  *float64 `json:"duration_ms,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Turns our `==> |  <==` log lines into JSON. Steps that start with
+// `==>` get a duration when they end with `<==`.
+type jsonLog struct {
+	sync.Mutex
+	out      io.Writer
+	pipeline string
+	bundle   string
+	steps    []time.Time // when each step we're in started
+}
+
+// Set when we log JSON; nil when we log text.
+var structured *jsonLog
+
+func (l *jsonLog) write(e logEntry) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if e.Level == "" {
+		e.Level = "info"
+	}
+	e.Pipeline, e.Bundle = l.pipeline, l.bundle
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.out.Write(append(line, '\n'))
+}
+
+func (l *jsonLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		e := logEntry{}
+		switch {
+		case strings.HasPrefix(line, "==> "):
+			l.steps = append(l.steps, time.Now())
+		case strings.HasPrefix(line, "<== ") && len(l.steps) > 0:
+			ms := float64(time.Since(l.steps[len(l.steps)-1])) / float64(time.Millisecond)
+			e.Duration = &ms
+			l.steps = l.steps[:len(l.steps)-1]
+		}
+		msg := line
+		for _, decoration := range []string{"==> ", "<== ", " |  "} {
+			msg = strings.TrimPrefix(msg, decoration)
+		}
+		msg = strings.TrimSpace(msg)
+		// the output of commands that already log JSON (like the
+		// manager) is passed on as is
+		output := strings.TrimPrefix(strings.TrimPrefix(msg, "> "), "! ")
+		if strings.HasPrefix(output, "{") && json.Valid([]byte(output)) {
+			l.out.Write([]byte(output + "\n"))
+			continue
+		}
+		e.Message = msg
+		l.write(e)
+	}
+	return len(p), nil
+}
+
+// Chooses how the CLI logs. Bundles and managers started with JSON logs
+// log JSON too.
+func SetLogFormat(format string, out io.Writer) error {
+	switch format {
+	case LogText, "":
+		structured = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(out)
+	case LogJSON:
+		structured = &jsonLog{out: out}
+		log.SetFlags(0)
+		log.SetOutput(structured)
+	default:
+		return fmt.Errorf("The log format must be '%s' or '%s', not '%s'.", LogText, LogJSON, format)
+	}
+	return nil
+}
+
+// Records which pipeline and bundle the command is working on, so JSON
+// log lines can say so.
+func logAbout(pipeline, bundle string) {
+	if structured == nil {
+		return
+	}
+	structured.Lock()
+	defer structured.Unlock()
+	structured.pipeline, structured.bundle = pipeline, bundle
+}
+
+// The environment for the containers we start.
+func containerEnv(pipeline string) map[string]string {
+	env := map[string]string{pipelineEnv: pipeline}
+	if structured != nil {
+		env[LogFormatEnv] = LogJSON
+	}
+	return env
+}
+
+// The `docker run` arguments that set the environment.
+func dockerEnvArgs(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []string{}
+	for _, name := range names {
+		args = append(args, "-e", fmt.Sprintf("%s=%s", name, env[name]))
+	}
+	return args
+}
+
+// Reports the error that ended a command. With JSON logs, it's logged
+// and we exit; otherwise we panic, with a stack trace.
+func Fail(err error) {
+	if structured == nil {
+		panic(err)
+	}
+	structured.Lock()
+	structured.write(logEntry{Level: "error", Message: "Command failed.", Error: err.Error()})
+	structured.Unlock()
+	os.Exit(1)
+}
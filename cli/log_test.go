@@ -0,0 +1,81 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/qadium/plumber/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogs(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	buf := new(bytes.Buffer)
+	if err := cli.SetLogFormat(cli.LogJSON, buf); err != nil {
+		t.Fatalf("SetLogFormat: got unexpected error '%v'", err)
+	}
+	defer cli.SetLogFormat(cli.LogText, os.Stderr)
+
+	// this tells the logs which pipeline and bundle we're working on
+	ctx.ShadowReport("foo", "hello", tempDir+"/missing.jsonl", ioutil.Discard)
+	log.Printf("==> Doing things")
+	log.Printf(" |  A step.")
+	log.Printf("    > %s", `{"level":"info","msg":"from the manager"}`)
+	log.Printf("    ! not json")
+	log.Printf("<== Done.")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("JSONLogs: got %d lines:\n%s", len(lines), buf)
+	}
+	entries := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			t.Fatalf("JSONLogs: '%s' is not JSON", line)
+		}
+	}
+	expected := []string{"Doing things", "A step.", "from the manager", "! not json", "Done."}
+	for i, msg := range expected {
+		if entries[i]["msg"] != msg {
+			t.Errorf("JSONLogs: expected message '%s'; got '%v'", msg, entries[i]["msg"])
+		}
+	}
+	if entries[0]["pipeline"] != "foo" || entries[0]["bundle"] != "hello" || entries[0]["level"] != "info" || entries[0]["time"] == nil {
+		t.Errorf("JSONLogs: unexpected entry %v", entries[0])
+	}
+	if _, ok := entries[2]["pipeline"]; ok {
+		t.Errorf("JSONLogs: expected the manager's line to be passed on as is; got %v", entries[2])
+	}
+	if _, ok := entries[4]["duration_ms"]; !ok {
+		t.Errorf("JSONLogs: expected a duration at the end of a step; got %v", entries[4])
+	}
+	if _, ok := entries[1]["duration_ms"]; ok {
+		t.Errorf("JSONLogs: expected no duration in the middle of a step; got %v", entries[1])
+	}
+}
+
+func TestSetLogFormatInvalid(t *testing.T) {
+	if err := cli.SetLogFormat("xml", os.Stderr); err == nil {
+		t.Error("SetLogFormat: expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,160 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The manager appends recorded traffic to this file in the pipeline's
+// recording directory.
+const recordingFile = "recording.jsonl"
+
+// Replayed requests have this header, so the manager doesn't record
+// them again.
+const replayHeader = "X-Plumber-Replay"
+
+// A record sent to a pipeline and the response it got. This must match
+// the `recording` struct in the manager.
+type Recording struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Pipeline string          `json:"pipeline,omitempty"`
+	Record   json.RawMessage `json:"record"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func readRecordings(filename string) ([]Recording, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	recordings := []Recording{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var recording Recording
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, recording)
+	}
+	return recordings, scanner.Err()
+}
+
+// The manager's lineage metadata has timings in it, so it's different
+// every time; replays ignore it.
+const lineageField = "_plumber"
+
+func withoutLineage(record json.RawMessage) json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	if json.Unmarshal(record, &fields) != nil {
+		return record
+	}
+	if _, ok := fields[lineageField]; !ok {
+		return record
+	}
+	delete(fields, lineageField)
+	stripped, err := json.Marshal(fields)
+	if err != nil {
+		return record
+	}
+	return stripped
+}
+
+// Sends recorded traffic through a running pipeline again and prints
+// every record whose response changed: either its status, or the fields
+// that were added, removed or changed. Error messages and `_plumber`
+// lineage aren't compared.
+// `filename` defaults to the pipeline's own recording. Returns the
+// number of records that changed.
+func (ctx *Context) Replay(pipeline, managerUrl, filename string, out io.Writer) (int, error) {
+	logAbout(pipeline, "")
+	log.Printf("==> Replaying recorded traffic for '%s' pipeline", pipeline)
+	defer log.Printf("<== Replay complete.")
+
+	client, err := ctx.newManagerClient(pipeline, managerUrl, time.Minute)
+	if err != nil {
+		return 0, err
+	}
+	// the manager only believes admins when they say they're replaying
+	client.asAdmin()
+	if filename == "" {
+		filename = fmt.Sprintf("%s/%s", ctx.RecordingPath(pipeline), recordingFile)
+	}
+
+	log.Printf(" |  Reading '%s'.", filename)
+	recordings, err := readRecordings(filename)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("    Read %d records.", len(recordings))
+
+	log.Printf(" |  Sending records to '%s'.", client.url)
+	changed := 0
+	for _, recording := range recordings {
+		req, err := client.request("POST", "", bytes.NewReader(recording.Record))
+		if err != nil {
+			return changed, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-ID", recording.ID)
+		req.Header.Set(replayHeader, "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			return changed, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return changed, err
+		}
+
+		diff := []string{}
+		if resp.StatusCode != recording.Status {
+			diff = append(diff, fmt.Sprintf("status %d -> %d", recording.Status, resp.StatusCode))
+		}
+		if resp.StatusCode == http.StatusOK && recording.Status == http.StatusOK {
+			diff = append(diff, DiffRecords(withoutLineage(recording.Response), withoutLineage(body))...)
+		}
+		if len(diff) == 0 {
+			continue
+		}
+		changed++
+		fmt.Fprintf(out, "%s\t%s\n", recording.ID, recording.Time.Format(time.RFC3339))
+		for _, line := range diff {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d records changed.\n", changed, len(recordings))
+	return changed, nil
+}
@@ -0,0 +1,117 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testRecordings = `{"id":"r1","time":"2015-07-01T00:00:00Z","record":{"x":1},"status":200,"response":{"x":1,"y":2,"_plumber":{"stages":[{"bundle":"a","duration_ms":1.2}]}}}
+{"id":"r2","time":"2015-07-01T00:00:01Z","record":{"x":2},"status":200,"response":{"x":2,"y":3}}
+
+{"id":"r3","time":"2015-07-01T00:00:02Z","record":{"x":3},"status":200,"response":{"x":3,"y":4}}
+{"id":"r4","time":"2015-07-01T00:00:03Z","record":{"x":0},"status":422,"error":"oops"}
+`
+
+func TestReplay(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	dir := ctx.RecordingPath("rec")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/recording.jsonl", dir), []byte(testRecordings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the "new" pipeline changes r2 and fails r3; r1's lineage differs,
+	// but that doesn't count
+	replayed := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Plumber-Replay") != "" {
+			replayed++
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		switch buf.String() {
+		case `{"x":1}`:
+			w.Write([]byte(`{"y": 2, "x": 1, "_plumber": {"stages": [{"bundle": "a", "duration_ms": 3.4}]}}`))
+		case `{"x":2}`:
+			w.Write([]byte(`{"x":2,"y":5,"z":true}`))
+		case `{"x":3}`:
+			http.Error(w, "nope", http.StatusBadGateway)
+		default:
+			http.Error(w, "still nope", http.StatusUnprocessableEntity)
+		}
+	}))
+	defer ts.Close()
+
+	out := new(bytes.Buffer)
+	changed, err := ctx.Replay("rec", ts.URL, "", out)
+	if err != nil {
+		t.Fatalf("Replay: got unexpected error '%v'", err)
+	}
+	if replayed != 4 {
+		t.Errorf("Replay: manager got %d replayed records", replayed)
+	}
+	expected := "r2\t2015-07-01T00:00:01Z\n  ~ y: 3 -> 5\n  + z: true\n" +
+		"r3\t2015-07-01T00:00:02Z\n  status 200 -> 502\n" +
+		"2 of 4 records changed.\n"
+	if changed != 2 || out.String() != expected {
+		t.Errorf("Replay: got %d changes and printed '%s'", changed, out.String())
+	}
+
+	if _, err := ctx.Replay("rec", ts.URL, fmt.Sprintf("%s/missing.jsonl", dir), out); err == nil {
+		t.Error("Replay: expected an error for a missing recording")
+	}
+}
+
+// Test that replays are sent with the pipeline's admin token, since the
+// manager only believes admins when they say they're replaying.
+func TestReplayAsAdmin(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	dir := ctx.RecordingPath("rec")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/recording.jsonl", dir), []byte(testRecordings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := "auth:\n  apiKeys: [key]\nadmin:\n  tokens: [admin]\n"
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/.pipeline.yml", ctx.PipelinePath("rec")), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials = append(credentials, r.Header.Get("X-API-Key")+r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	if _, err := ctx.Replay("rec", ts.URL, "", new(bytes.Buffer)); err != nil {
+		t.Fatalf("Replay: got unexpected error '%v'", err)
+	}
+	if len(credentials) != 4 || credentials[0] != "Bearer admin" {
+		t.Errorf("Replay: manager got credentials '%v'", credentials)
+	}
+}
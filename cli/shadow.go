@@ -0,0 +1,164 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// The manager appends the results of shadow traffic to this file in
+// the pipeline's shadow directory.
+const shadowFile = "shadow.jsonl"
+
+// How a candidate's output for a record differed from its bundle's.
+// This must match the `shadowResult` struct in the manager.
+type ShadowResult struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	Pipeline       string    `json:"pipeline,omitempty"`
+	Bundle         string    `json:"bundle"`
+	Candidate      string    `json:"candidate"`
+	Match          bool      `json:"match"`
+	Added          []string  `json:"added,omitempty"`
+	Removed        []string  `json:"removed,omitempty"`
+	Changed        []string  `json:"changed,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	CandidateError string    `json:"candidateError,omitempty"`
+	Elapsed        float64   `json:"elapsed"`
+}
+
+func readShadowResults(filename string) ([]ShadowResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	results := []ShadowResult{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var result ShadowResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
+
+// What we know about one candidate.
+type shadowSummary struct {
+	bundle, candidate string
+	compared          int
+	matched           int
+	candidateErrors   int
+	elapsed           float64
+	fields            map[string]int // "added a", "changed b", ...
+}
+
+func countFields(counts map[string]int, what string, fields []string) {
+	for _, field := range fields {
+		counts[fmt.Sprintf("%s '%s'", what, field)]++
+	}
+}
+
+// Prints, for every candidate, how often its output matched its
+// bundle's and which fields it most often added, removed or changed.
+// Only the candidates for `bundle` are included, if it's set.
+// `filename` defaults to the pipeline's own shadow results.
+func (ctx *Context) ShadowReport(pipeline, bundle, filename string, out io.Writer) error {
+	logAbout(pipeline, bundle)
+	if filename == "" {
+		if _, err := ctx.GetPipeline(pipeline); err != nil {
+			return err
+		}
+		filename = fmt.Sprintf("%s/%s", ctx.ShadowPath(pipeline), shadowFile)
+	}
+	results, err := readShadowResults(filename)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "No shadow traffic.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	summaries := make(map[string]*shadowSummary)
+	keys := []string{}
+	for _, result := range results {
+		if bundle != "" && result.Bundle != bundle {
+			continue
+		}
+		key := result.Bundle + "\t" + result.Candidate
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &shadowSummary{bundle: result.Bundle, candidate: result.Candidate, fields: make(map[string]int)}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+		summary.compared++
+		summary.elapsed += result.Elapsed
+		if result.Match {
+			summary.matched++
+		}
+		if result.CandidateError != "" {
+			summary.candidateErrors++
+		}
+		countFields(summary.fields, "added", result.Added)
+		countFields(summary.fields, "removed", result.Removed)
+		countFields(summary.fields, "changed", result.Changed)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(out, "No shadow traffic.")
+		return nil
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		summary := summaries[key]
+		fmt.Fprintf(out, "%s -> %s\n", summary.bundle, summary.candidate)
+		fmt.Fprintf(out, "  %d compared, %d matched, %d differed, %d candidate errors\n",
+			summary.compared, summary.matched, summary.compared-summary.matched, summary.candidateErrors)
+		fmt.Fprintf(out, "  %.1fms average for the candidate\n", summary.elapsed/float64(summary.compared))
+
+		// most common differences first
+		diffs := []string{}
+		for diff := range summary.fields {
+			diffs = append(diffs, diff)
+		}
+		sort.Slice(diffs, func(i, j int) bool {
+			if summary.fields[diffs[i]] != summary.fields[diffs[j]] {
+				return summary.fields[diffs[i]] > summary.fields[diffs[j]]
+			}
+			return diffs[i] < diffs[j]
+		})
+		for _, diff := range diffs {
+			fmt.Fprintf(out, "  %s in %d records\n", diff, summary.fields[diff])
+		}
+	}
+	return nil
+}
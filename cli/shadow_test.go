@@ -0,0 +1,76 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testShadowResults = `{"id":"a-1","time":"2015-07-01T00:00:00Z","bundle":"b","candidate":"http://b-next","match":true,"elapsed":2}
+{"id":"a-2","time":"2015-07-01T00:00:01Z","bundle":"b","candidate":"http://b-next","match":false,"changed":["x"],"added":["y"],"elapsed":4}
+
+{"id":"a-3","time":"2015-07-01T00:00:02Z","bundle":"b","candidate":"http://b-next","match":false,"changed":["x"],"elapsed":6}
+{"id":"a-4","time":"2015-07-01T00:00:03Z","bundle":"c","candidate":"http://c-next","match":false,"candidateError":"oops","elapsed":1}
+`
+
+func TestShadowReport(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	out := new(bytes.Buffer)
+	if err := ctx.ShadowReport("shadow", "", "", out); err == nil {
+		t.Error("ShadowReport: expected an error for a missing pipeline")
+	}
+
+	shadows := ctx.ShadowPath("shadow")
+	if err := os.MkdirAll(shadows, 0755); err != nil {
+		t.Fatalf("Could not make shadow directory; got error '%v'", err)
+	}
+	if err := ctx.ShadowReport("shadow", "", "", out); err != nil || out.String() != "No shadow traffic.\n" {
+		t.Errorf("ShadowReport: got '%s' and error '%v' without any results", out, err)
+	}
+
+	filename := fmt.Sprintf("%s/shadow.jsonl", shadows)
+	if err := ioutil.WriteFile(filename, []byte(testShadowResults), 0644); err != nil {
+		t.Fatalf("Could not write shadow results; got error '%v'", err)
+	}
+	out.Reset()
+	if err := ctx.ShadowReport("shadow", "", "", out); err != nil {
+		t.Fatalf("ShadowReport: got unexpected error '%v'", err)
+	}
+	expected := `b -> http://b-next
+  3 compared, 1 matched, 2 differed, 0 candidate errors
+  4.0ms average for the candidate
+  changed 'x' in 2 records
+  added 'y' in 1 records
+c -> http://c-next
+  1 compared, 0 matched, 1 differed, 1 candidate errors
+  1.0ms average for the candidate
+`
+	if out.String() != expected {
+		t.Errorf("ShadowReport: got\n%s\nexpected\n%s", out, expected)
+	}
+
+	out.Reset()
+	if err := ctx.ShadowReport("shadow", "c", filename, out); err != nil || strings.Contains(out.String(), "b -> ") {
+		t.Errorf("ShadowReport: got '%s' and error '%v' for bundle 'c'", out, err)
+	}
+}
@@ -16,6 +16,8 @@
 package cli
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	//	"gopkg.in/yaml.v2"
@@ -24,9 +26,13 @@ import (
 	"github.com/qadium/plumber/bindata"
 	"github.com/qadium/plumber/graph"
 	"github.com/qadium/plumber/shell"
+	"io/ioutil"
+	"net/http"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 	// "golang.org/x/oauth2/google"
 	// "golang.org/x/oauth2"
 	// "google.golang.org/cloud"
@@ -38,20 +44,143 @@ import (
 )
 
 type pipelineInfo struct {
-	path   string
-	name   string
-	commit string
+	path         string
+	name         string
+	commit       string
+	bundles      map[string]*Bundle
+	dependencies map[string][]string // maps a bundle to the bundles it depends on
+	settings     *Pipeline
 }
 
+// The pipeline description handed to the manager. This must match the
+// `pipeline` and `stage` structs in the manager.
+type managerStage struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url,omitempty"`
+	URLs      []string   `json:"urls,omitempty"`
+	Balance   *Balance   `json:"balance,omitempty"`
+	Depends   []string   `json:"depends,omitempty"`
+	Inputs    []string   `json:"inputs,omitempty"`
+	Outputs   []string   `json:"outputs,omitempty"`
+	Optional  []string   `json:"optional,omitempty"`
+	Policy    *Policy    `json:"policy,omitempty"`
+	Limits    *Limits    `json:"limits,omitempty"`
+	Cache     *Cache     `json:"cache,omitempty"`
+	Admission *Admission `json:"admission,omitempty"`
+	Shadow    *Shadow    `json:"shadow,omitempty"`
+	Image     string     `json:"image,omitempty"`
+}
+
+type managerPipeline struct {
+	Name          string         `json:"name"`
+	Stages        []managerStage `json:"stages"`
+	DeadLetterDir string         `json:"deadLetterDir,omitempty"`
+	ShadowDir     string         `json:"shadowDir,omitempty"`
+	Merge         *Merge         `json:"merge,omitempty"`
+	Limits        *Limits        `json:"limits,omitempty"`
+	Admission     *Admission     `json:"admission,omitempty"`
+	Record        *Record        `json:"record,omitempty"`
+	Auth          *Auth          `json:"auth,omitempty"`
+	Admin         *Auth          `json:"admin,omitempty"`
+	Lineage       bool           `json:"lineage,omitempty"`
+	EnhancerTLS   *EnhancerTLS   `json:"enhancerTLS,omitempty"`
+}
+
+// Where the dead letter directory is mounted in local manager
+// containers.
+const managerDlqDir = "/plumber/dlq"
+
+// Where the recording directory is mounted in local manager
+// containers.
+const managerRecordDir = "/plumber/recordings"
+
+// Where the shadow directory is mounted in local manager containers.
+const managerShadowDir = "/plumber/shadow"
+
+// Where the config directory is mounted in local manager containers.
+const managerConfigDir = "/plumber/config"
+
+// Where the manager's TLS certificate and key are mounted in local
+// manager containers.
+const (
+	managerTLSDir  = "/plumber/tls"
+	managerTLSCert = "tls.crt"
+	managerTLSKey  = "tls.key"
+)
+
+// The names of the files the manager uses to connect to bundles over
+// HTTPS. They're mounted next to the manager's own certificate and key.
+const (
+	managerEnhancerCA   = "enhancer-ca.crt"
+	managerEnhancerCert = "enhancer.crt"
+	managerEnhancerKey  = "enhancer.key"
+)
+
+// Maps the names the enhancer TLS files are mounted as to the files
+// in the pipeline's settings.
+func (t *EnhancerTLS) files() map[string]string {
+	files := make(map[string]string)
+	for name, file := range map[string]string{
+		managerEnhancerCA:   t.CA,
+		managerEnhancerCert: t.Cert,
+		managerEnhancerKey:  t.Key,
+	} {
+		if file != "" {
+			files[name] = file
+		}
+	}
+	return files
+}
+
+// The settings the manager needs once the files are mounted in `dir`.
+func (t *EnhancerTLS) mountedIn(dir string) *EnhancerTLS {
+	mounted := &EnhancerTLS{}
+	if t.CA != "" {
+		mounted.CA = fmt.Sprintf("%s/%s", dir, managerEnhancerCA)
+	}
+	if t.Cert != "" {
+		mounted.Cert = fmt.Sprintf("%s/%s", dir, managerEnhancerCert)
+		mounted.Key = fmt.Sprintf("%s/%s", dir, managerEnhancerKey)
+	}
+	return mounted
+}
+
+// Where the manager's secret is mounted on GCE. It holds the TLS
+// certificate and key, the enhancer TLS files and, if the pipeline has
+// API keys or tokens, the manager's config.
+const managerSecretDir = "/plumber/secret"
+
+// The flags that make the manager serve HTTPS with the certificate and
+// key in `dir`.
+func managerTLSArgs(dir string) []string {
+	return []string{
+		"-tls-cert", fmt.Sprintf("%s/%s", dir, managerTLSCert),
+		"-tls-key", fmt.Sprintf("%s/%s", dir, managerTLSKey),
+	}
+}
+
+// How long the manager keeps serving on GCE, while not ready, before it
+// shuts down, so the load balancer stops sending it records first.
+const managerDrainDelay = "5s"
+
+// How long `plumber start` waits for local bundles to respond before
+// giving up.
+const bundleStartTimeout = 30 * time.Second
+
 type kubeData struct {
-	BundleName     string
-	ExternalFacing bool
-	PipelineName   string
-	PipelineCommit string
-	PlumberVersion string
-	PlumberCommit  string
-	ImageName      string
-	Args           []string
+	BundleName      string
+	ExternalFacing  bool
+	ReadinessPath   string // the path kubernetes checks to see if we're ready
+	ReadinessScheme string // HTTP or HTTPS; HTTP if empty
+	PipelineName    string
+	PipelineCommit  string
+	PlumberVersion  string
+	PlumberCommit   string
+	ImageName       string
+	Args            []string
+	Env             map[string]string
+	Secret          string            // the secret mounted at /plumber/secret, if any
+	SecretData      map[string]string // base64 encoded, for the secret template
 }
 
 func bundlesToGraphs(bundles []*Bundle) []*graph.Node {
@@ -77,47 +206,276 @@ func bundlesToGraphs(bundles []*Bundle) []*graph.Node {
 	return nodes
 }
 
-func localStart(ctx *Context, sortedPipeline []string) error {
+// Maps each bundle's name to the names of the bundles that provide its
+// inputs.
+func bundleDependencies(bundles []*Bundle) map[string][]string {
+	// this map maps outputs to the names of the bundles that provide it
+	m := make(map[string][]string)
+	for _, bundle := range bundles {
+		for _, output := range bundle.Outputs {
+			m[output.Name] = append(m[output.Name], bundle.Name)
+		}
+	}
+
+	deps := make(map[string][]string)
+	for _, bundle := range bundles {
+		seen := make(map[string]bool)
+		for _, input := range bundle.Inputs {
+			for _, provider := range m[input.Name] {
+				if provider != bundle.Name && !seen[provider] {
+					seen[provider] = true
+					deps[bundle.Name] = append(deps[bundle.Name], provider)
+				}
+			}
+		}
+	}
+	return deps
+}
+
+// Builds the manager's description of the pipeline from the reverse
+// sorted pipeline and the urls of each bundle's replicas.
+func newManagerPipeline(sortedPipeline []string, pipeline pipelineInfo, urls map[string][]string, images map[string]string) *managerPipeline {
+	config := &managerPipeline{Name: pipeline.name}
+	if pipeline.settings != nil {
+		config.Merge = pipeline.settings.Merge
+		config.Limits = pipeline.settings.Limits
+		config.Admission = pipeline.settings.Admission
+		config.Auth = pipeline.settings.Auth
+		config.Admin = pipeline.settings.Admin
+		config.Lineage = pipeline.settings.Lineage
+	}
+	for i := len(sortedPipeline) - 1; i >= 0; i-- {
+		bundleName := sortedPipeline[i]
+		bundle := pipeline.bundles[bundleName]
+		inputs := make([]string, len(bundle.Inputs))
+		var optional []string
+		for j, input := range bundle.Inputs {
+			inputs[j] = input.Name
+			if input.Optional {
+				optional = append(optional, input.Name)
+			}
+		}
+		outputs := make([]string, len(bundle.Outputs))
+		for j, output := range bundle.Outputs {
+			outputs[j] = output.Name
+		}
+		stage := managerStage{
+			Name:      bundleName,
+			Depends:   pipeline.dependencies[bundleName],
+			Inputs:    inputs,
+			Outputs:   outputs,
+			Optional:  optional,
+			Policy:    bundle.Policy,
+			Limits:    bundle.Limits,
+			Cache:     bundle.Cache,
+			Admission: bundle.Admission,
+			Shadow:    bundle.Shadow,
+			Image:     images[bundleName],
+		}
+		if replicas := urls[bundleName]; len(replicas) == 1 {
+			stage.URL = replicas[0]
+		} else {
+			stage.URLs = replicas
+			stage.Balance = bundle.Balance
+		}
+		config.Stages = append(config.Stages, stage)
+	}
+	return config
+}
+
+// The id of each bundle's image, so the manager can say which version
+// of a bundle set each field. Only pipelines with lineage need them.
+func bundleImages(ctx *Context, sortedPipeline []string, pipeline pipelineInfo) (map[string]string, error) {
+	if pipeline.settings == nil || !pipeline.settings.Lineage {
+		return nil, nil
+	}
+	log.Printf(" |  Looking up bundle versions for lineage.")
+	images := make(map[string]string)
+	for _, bundleName := range sortedPipeline {
+		id, err := exec.Command(ctx.DockerCmd, "inspect", "--format", "{{.Id}}", ctx.GetImage(bundleName)).Output()
+		if err != nil {
+			return nil, err
+		}
+		images[bundleName] = strings.TrimSpace(string(id))
+		log.Printf("    '%s' is %s.", bundleName, images[bundleName])
+	}
+	return images, nil
+}
+
+// The manager takes its description of the pipeline as a JSON argument.
+func (config *managerPipeline) arg() (string, error) {
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// Writes the config to `filename`. The manager reloads it when it
+// changes, so we write a temporary file and rename it over the old one;
+// the manager never sees a partial config.
+func (config *managerPipeline) write(filename string) error {
+	bytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(bytes, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Waits for every bundle to respond at /info. The python wrapper
+// serves /info as soon as the bundle is ready for data.
+func waitForBundles(urls map[string][]string, timeout time.Duration) error {
+	log.Printf(" |  Waiting for bundles to respond.")
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: time.Second}
+	for bundleName, replicas := range urls {
+		for _, url := range replicas {
+			for {
+				resp, err := client.Get(url + "/info")
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode == http.StatusOK {
+						break
+					}
+				}
+				if time.Now().After(deadline) {
+					return fmt.Errorf("Bundle '%s' did not respond at '%s/info'.", bundleName, url)
+				}
+				time.Sleep(250 * time.Millisecond)
+			}
+		}
+		log.Printf("    '%s' is up.", bundleName)
+	}
+	log.Printf("    Done.")
+	return nil
+}
+
+func localStart(ctx *Context, sortedPipeline []string, pipeline pipelineInfo) error {
 	log.Printf(" |  Starting bundles...")
-	managerDockerArgs := []string{"run", "-p", "9800:9800", "--rm", ctx.GetManagerImage()}
+	urls := make(map[string][]string)
 	// walk through the reverse sorted bundles and start them up
 	for i := len(sortedPipeline) - 1; i >= 0; i-- {
 		bundleName := sortedPipeline[i]
-		log.Printf("    Starting: '%s'", bundleName)
-		cmd := exec.Command(ctx.DockerCmd, "run", "-d", "-P", ctx.GetImage(bundleName))
-		containerId, err := cmd.Output()
-		if err != nil {
-			return err
+		replicas := pipeline.bundles[bundleName].Replicas
+		if replicas == 0 {
+			replicas = 1
 		}
+		for r := 0; r < replicas; r++ {
+			log.Printf("    Starting: '%s' (%d of %d)", bundleName, r+1, replicas)
+			args := append([]string{"run", "-d", "-P"}, dockerEnvArgs(containerEnv(pipeline.name))...)
+			cmd := exec.Command(ctx.DockerCmd, append(args, ctx.GetImage(bundleName))...)
+			containerId, err := cmd.Output()
+			if err != nil {
+				return err
+			}
 
-		defer func() {
-			log.Printf("    Stopping: '%s'", bundleName)
-			cmd := exec.Command(ctx.DockerCmd, "rm", "-f", string(containerId)[0:4])
-			_, err := cmd.Output()
+			defer func() {
+				log.Printf("    Stopping: '%s'", bundleName)
+				cmd := exec.Command(ctx.DockerCmd, "rm", "-f", string(containerId)[0:4])
+				_, err := cmd.Output()
+				if err != nil {
+					panic(err)
+				}
+				log.Printf("    Stopped.")
+			}()
+
+			log.Printf("    Started: %s", string(containerId))
+			cmd = exec.Command(ctx.DockerCmd, "inspect", "--format='{{(index (index .NetworkSettings.Ports \"9800/tcp\") 0).HostPort}}'", string(containerId)[0:4])
+			portNum, err := cmd.Output()
 			if err != nil {
-				panic(err)
+				return err
 			}
-			log.Printf("    Stopped.")
-		}()
+			// get the docker host IP for local deploy
+			hostIp, err := ctx.GetDockerHost()
+			if err != nil {
+				return err
+			}
+			urls[bundleName] = append(urls[bundleName], fmt.Sprintf("http://%s:%s", hostIp, string(portNum[:len(portNum)-1])))
+		}
+	}
+	log.Printf("    Done.")
 
-		log.Printf("    Started: %s", string(containerId))
-		cmd = exec.Command(ctx.DockerCmd, "inspect", "--format='{{(index (index .NetworkSettings.Ports \"9800/tcp\") 0).HostPort}}'", string(containerId)[0:4])
-		portNum, err := cmd.Output()
-		if err != nil {
+	log.Printf(" |  Creating '%s' directory for dead letters.", ctx.DlqSubdir)
+	dlq := ctx.DeadLetterPath(pipeline.name)
+	if err := os.MkdirAll(dlq, 0755); err != nil {
+		return err
+	}
+	log.Printf("    Created.")
+
+	// the manager reloads this file when it changes, so the pipeline
+	// can be edited while it runs
+	configPath := ctx.ManagerConfigPath(pipeline.name)
+	log.Printf(" |  Writing manager config to '%s'.", configPath)
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	images, err := bundleImages(ctx, sortedPipeline, pipeline)
+	if err != nil {
+		return err
+	}
+	config := newManagerPipeline(sortedPipeline, pipeline, urls, images)
+	config.DeadLetterDir = managerDlqDir
+	managerDockerArgs := []string{"run", "-p", "9800:9800", "--rm",
+		"-v", fmt.Sprintf("%s:%s", dlq, managerDlqDir),
+		"-v", fmt.Sprintf("%s:%s", filepath.Dir(configPath), managerConfigDir)}
+	managerDockerArgs = append(managerDockerArgs, dockerEnvArgs(containerEnv(pipeline.name))...)
+	if pipeline.settings != nil && pipeline.settings.Record != nil {
+		recordings := ctx.RecordingPath(pipeline.name)
+		log.Printf("    Recording traffic to '%s'.", recordings)
+		if err := os.MkdirAll(recordings, 0755); err != nil {
 			return err
 		}
-		// get the docker host IP for local deploy
-		hostIp, err := ctx.GetDockerHost()
-		if err != nil {
+		config.Record = &Record{Dir: managerRecordDir, Sample: pipeline.settings.Record.Sample}
+		managerDockerArgs = append(managerDockerArgs, "-v", fmt.Sprintf("%s:%s", recordings, managerRecordDir))
+	}
+	for _, stage := range config.Stages {
+		if stage.Shadow == nil {
+			continue
+		}
+		shadows := ctx.ShadowPath(pipeline.name)
+		log.Printf("    Keeping shadow results in '%s'.", shadows)
+		if err := os.MkdirAll(shadows, 0755); err != nil {
 			return err
 		}
-		managerDockerArgs = append(managerDockerArgs, fmt.Sprintf("http://%s:%s", hostIp, string(portNum[:len(portNum)-1])))
+		config.ShadowDir = managerShadowDir
+		managerDockerArgs = append(managerDockerArgs, "-v", fmt.Sprintf("%s:%s", shadows, managerShadowDir))
+		break
+	}
+	var tlsArgs []string
+	if pipeline.settings != nil && pipeline.settings.TLS != nil {
+		log.Printf("    Serving HTTPS with '%s'.", pipeline.settings.TLS.Cert)
+		managerDockerArgs = append(managerDockerArgs,
+			"-v", fmt.Sprintf("%s:%s/%s:ro", pipeline.settings.TLS.Cert, managerTLSDir, managerTLSCert),
+			"-v", fmt.Sprintf("%s:%s/%s:ro", pipeline.settings.TLS.Key, managerTLSDir, managerTLSKey))
+		tlsArgs = managerTLSArgs(managerTLSDir)
+	}
+	if pipeline.settings != nil && pipeline.settings.EnhancerTLS != nil {
+		log.Printf("    Connecting to bundles over HTTPS with the 'enhancerTLS' settings.")
+		for name, file := range pipeline.settings.EnhancerTLS.files() {
+			managerDockerArgs = append(managerDockerArgs, "-v", fmt.Sprintf("%s:%s/%s:ro", file, managerTLSDir, name))
+		}
+		config.EnhancerTLS = pipeline.settings.EnhancerTLS.mountedIn(managerTLSDir)
+	}
+	if err := config.write(configPath); err != nil {
+		return err
+	}
+	log.Printf("    Written.")
+
+	managerDockerArgs = append(managerDockerArgs, ctx.GetManagerImage(),
+		"-config", fmt.Sprintf("%s/%s", managerConfigDir, filepath.Base(configPath)))
+	managerDockerArgs = append(managerDockerArgs, tlsArgs...)
+
+	if err := waitForBundles(urls, bundleStartTimeout); err != nil {
+		return err
 	}
-	log.Printf("    Done.")
 	log.Printf("    Args passed to 'docker': %v", managerDockerArgs)
 
 	log.Printf(" |  Running manager. CTRL-C to quit.")
-	err := shell.RunAndLog(ctx.DockerCmd, managerDockerArgs...)
+	err = shell.RunAndLog(ctx.DockerCmd, managerDockerArgs...)
 	if err != nil {
 		return err
 	}
@@ -162,6 +520,15 @@ func writeKubernetesFiles(ctx *Context, templateData kubeData) error {
 	}
 	log.Printf("       Created.")
 
+	if templateData.Secret != "" {
+		log.Printf("       Creating secret file.")
+		err = writeKubernetesTemplate("secret", fmt.Sprintf("%s/%s-secret.yaml", k8s, templateData.BundleName), templateData)
+		if err != nil {
+			return err
+		}
+		log.Printf("       Created.")
+	}
+
 	log.Printf("       Creating replication controller file.")
 	err = writeKubernetesTemplate("replication-controller", fmt.Sprintf("%s/%s-rc.yaml", k8s, templateData.BundleName), templateData)
 	if err != nil {
@@ -182,7 +549,7 @@ func remoteStart(ctx *Context, sortedPipeline []string, projectId string, pipeli
 	}
 	log.Printf("   Created.")
 
-	args := []string{}
+	urls := make(map[string][]string)
 
 	for i := len(sortedPipeline) - 1; i >= 0; i-- {
 		bundleName := sortedPipeline[i]
@@ -196,7 +563,9 @@ func remoteStart(ctx *Context, sortedPipeline []string, projectId string, pipeli
 			PipelineName:   pipeline.name,
 			PipelineCommit: pipeline.commit,
 			ExternalFacing: false,
+			ReadinessPath:  "/info",
 			Args:           []string{},
+			Env:            containerEnv(pipeline.name),
 		}
 
 		// step 1. re-tag local containers to gcr.io/$GCE/$pipeline-$bundlename
@@ -216,9 +585,13 @@ func remoteStart(ctx *Context, sortedPipeline []string, projectId string, pipeli
 			return err
 		}
 
-		// append to arglist (args now in sorted order)
-		args = append(args, fmt.Sprintf("http://%s:9800", bundleName))
+		urls[bundleName] = []string{fmt.Sprintf("http://%s:9800", bundleName)}
 	}
+	images, err := bundleImages(ctx, sortedPipeline, pipeline)
+	if err != nil {
+		return err
+	}
+	config := newManagerPipeline(sortedPipeline, pipeline, urls, images)
 	// create the manager service
 	data := kubeData{
 		BundleName:     "manager",
@@ -228,11 +601,58 @@ func remoteStart(ctx *Context, sortedPipeline []string, projectId string, pipeli
 		PipelineName:   pipeline.name,
 		PipelineCommit: pipeline.commit,
 		ExternalFacing: true,
-		Args:           args,
+		ReadinessPath:  "/readyz",
+		Args:           []string{"-drain-delay", managerDrainDelay},
+		Env:            containerEnv(pipeline.name),
+	}
+	// certificates, keys and any API keys or tokens go in a
+	// secret that's mounted into the manager, rather than in the
+	// replication controller, where anyone who can read it sees them
+	secrets := make(map[string][]byte)
+	if pipeline.settings != nil && pipeline.settings.TLS != nil {
+		for name, file := range map[string]string{
+			managerTLSCert: pipeline.settings.TLS.Cert,
+			managerTLSKey:  pipeline.settings.TLS.Key,
+		} {
+			if secrets[name], err = ioutil.ReadFile(file); err != nil {
+				return err
+			}
+		}
+		data.Args = append(data.Args, managerTLSArgs(managerSecretDir)...)
+		data.ReadinessScheme = "HTTPS"
+	}
+	if pipeline.settings != nil && pipeline.settings.EnhancerTLS != nil {
+		for name, file := range pipeline.settings.EnhancerTLS.files() {
+			if secrets[name], err = ioutil.ReadFile(file); err != nil {
+				return err
+			}
+		}
+		config.EnhancerTLS = pipeline.settings.EnhancerTLS.mountedIn(managerSecretDir)
+	}
+	if config.Auth != nil || config.Admin != nil {
+		if secrets[managerConfigFile], err = json.Marshal(config); err != nil {
+			return err
+		}
+		data.Args = append(data.Args, "-config", fmt.Sprintf("%s/%s", managerSecretDir, managerConfigFile))
+		log.Printf("    The manager's API keys and tokens will be kept in a secret.")
+	} else {
+		// flags have to come before the pipeline
+		args, err := config.arg()
+		if err != nil {
+			return err
+		}
+		data.Args = append(data.Args, args)
+	}
+	if len(secrets) > 0 {
+		data.Secret = fmt.Sprintf("%s-manager", pipeline.name)
+		data.SecretData = make(map[string]string)
+		for name, contents := range secrets {
+			data.SecretData[name] = base64.StdEncoding.EncodeToString(contents)
+		}
 	}
 	// step 1. re-tag local containers to gcr.io/$GCE/$pipeline-$bundlename
 	log.Printf("    Retagging: '%s'", ctx.GetManagerImage())
-	err := shell.RunAndLog(ctx.DockerCmd, "tag", "-f", ctx.GetManagerImage(), data.ImageName)
+	err = shell.RunAndLog(ctx.DockerCmd, "tag", "-f", ctx.GetManagerImage(), data.ImageName)
 	if err != nil {
 		return err
 	}
@@ -257,6 +677,7 @@ func remoteStart(ctx *Context, sortedPipeline []string, projectId string, pipeli
 }
 
 func (ctx *Context) Start(pipeline, gce string) error {
+	logAbout(pipeline, "")
 	log.Printf("==> Starting '%s' pipeline", pipeline)
 	defer log.Printf("<== '%s' finished.", pipeline)
 
@@ -271,12 +692,22 @@ func (ctx *Context) Start(pipeline, gce string) error {
 		return err
 	}
 
-	ctxs := make([]*Bundle, len(configs))
-	for i, config := range configs {
-		ctxs[i], err = ParseBundle(config)
+	ctxs := make([]*Bundle, 0, len(configs))
+	for _, config := range configs {
+		// the pipeline's own settings aren't a bundle
+		if filepath.Base(config) == pipelineConfig {
+			continue
+		}
+		bundle, err := ParseBundle(config)
 		if err != nil {
 			return err
 		}
+		ctxs = append(ctxs, bundle)
+	}
+
+	settings, err := ParsePipelineFromDir(path)
+	if err != nil {
+		return err
 	}
 
 	g := bundlesToGraphs(ctxs)
@@ -287,6 +718,17 @@ func (ctx *Context) Start(pipeline, gce string) error {
 	log.Printf("    Reverse sorted: %v", sortedPipeline)
 	log.Printf("    Completed.")
 
+	info := pipelineInfo{
+		name:         pipeline,
+		path:         path,
+		commit:       "",
+		bundles:      make(map[string]*Bundle),
+		dependencies: bundleDependencies(ctxs),
+		settings:     settings,
+	}
+	for _, bundle := range ctxs {
+		info.bundles[bundle.Name] = bundle
+	}
 	if gce != "" {
 		// start GOOGLE experiments?
 		// when start is invoked with --gce PROJECT_ID, this piece of code
@@ -323,15 +765,10 @@ func (ctx *Context) Start(pipeline, gce string) error {
 
 		// end GOOGLE experiments
 
-		info := pipelineInfo{
-			name:   pipeline,
-			path:   path,
-			commit: "",
-		}
 		log.Printf(" |  Running remote pipeline.")
 		return remoteStart(ctx, sortedPipeline, gce, info)
 	} else {
 		log.Printf(" |  Running local pipeline.")
-		return localStart(ctx, sortedPipeline)
+		return localStart(ctx, sortedPipeline, info)
 	}
 }
@@ -0,0 +1,157 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A copy of what a bundle was sent and what it passed on. This must
+// match the `tapEvent` struct in the manager.
+type TapEvent struct {
+	ID      string          `json:"id"`
+	Bundle  string          `json:"bundle"`
+	Time    time.Time       `json:"time"`
+	Elapsed float64         `json:"elapsed"` // milliseconds
+	Skipped bool            `json:"skipped,omitempty"`
+	Input   json.RawMessage `json:"input"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Prints a sample of the records going through a bundle of a running
+// pipeline, along with what the bundle changed, until the manager goes
+// away. `sample` is the fraction of records to print.
+func (ctx *Context) Tap(pipeline, bundle, managerUrl string, sample float64, out io.Writer) error {
+	logAbout(pipeline, bundle)
+	// the tap stays open until the manager goes away
+	client, err := ctx.newManagerClient(pipeline, managerUrl, 0)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"bundle": {bundle}, "sample": {fmt.Sprint(sample)}}
+	log.Printf("==> Tapping '%s' in '%s' pipeline at '%s'", bundle, pipeline, client.url)
+	req, err := client.request("GET", "/tap?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Could not tap '%s': %s %s", bundle, resp.Status, bytes.TrimSpace(body))
+	}
+
+	// server-sent events are separated by blank lines; we only care
+	// about the data
+	reader := bufio.NewReader(resp.Body)
+	data := new(bytes.Buffer)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		} else if strings.TrimSpace(line) == "" && data.Len() > 0 {
+			var event TapEvent
+			if err := json.Unmarshal(data.Bytes(), &event); err != nil {
+				return err
+			}
+			printTapEvent(out, event)
+			data.Reset()
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func printTapEvent(out io.Writer, event TapEvent) {
+	fmt.Fprintf(out, "%s\t%s\t%s\t%.1fms\n", event.ID, event.Bundle, event.Time.Format(time.RFC3339), event.Elapsed)
+	switch {
+	case event.Error != "":
+		fmt.Fprintf(out, "  ! %s\n", event.Error)
+	case event.Skipped:
+		fmt.Fprintf(out, "  skipped\n")
+	default:
+		for _, line := range DiffRecords(event.Input, event.Output) {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+}
+
+// Describes how one record differs from another, one field per line:
+// `+` for added fields, `-` for removed fields and `~` for changed
+// fields. Records that aren't JSON objects are compared as a whole.
+func DiffRecords(input, output json.RawMessage) []string {
+	before := make(map[string]json.RawMessage)
+	after := make(map[string]json.RawMessage)
+	if json.Unmarshal(input, &before) != nil || json.Unmarshal(output, &after) != nil {
+		if compact(input) == compact(output) {
+			return nil
+		}
+		return []string{fmt.Sprintf("~ %s -> %s", compact(input), compact(output))}
+	}
+
+	names := []string{}
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		old, hadOld := before[name]
+		value, hasValue := after[name]
+		switch {
+		case !hadOld:
+			lines = append(lines, fmt.Sprintf("+ %s: %s", name, compact(value)))
+		case !hasValue:
+			lines = append(lines, fmt.Sprintf("- %s: %s", name, compact(old)))
+		case compact(old) != compact(value):
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", name, compact(old), compact(value)))
+		}
+	}
+	return lines
+}
+
+func compact(value json.RawMessage) string {
+	buf := new(bytes.Buffer)
+	if err := json.Compact(buf, value); err != nil {
+		return string(value)
+	}
+	return buf.String()
+}
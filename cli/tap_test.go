@@ -0,0 +1,86 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cli_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/qadium/plumber/cli"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiffRecords(t *testing.T) {
+	diff := cli.DiffRecords(json.RawMessage(`{"a": 1, "b": 2, "c": [1, 2]}`), json.RawMessage(`{"a":1,"b":3,"d":true}`))
+	if fmt.Sprint(diff) != "[~ b: 2 -> 3 - c: [1,2] + d: true]" {
+		t.Errorf("DiffRecords: got '%v'", diff)
+	}
+	if diff := cli.DiffRecords(json.RawMessage(`"x"`), json.RawMessage(`"y"`)); fmt.Sprint(diff) != `[~ "x" -> "y"]` {
+		t.Errorf("DiffRecords: got '%v' for non-objects", diff)
+	}
+}
+
+func TestTap(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	if err := os.MkdirAll(ctx.PipelinePath("tap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	query := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": tapping 'hello'\n\n")
+		fmt.Fprint(w, `event: record`+"\n"+`data: {"id":"r1","bundle":"hello","time":"2015-07-01T00:00:00Z","elapsed":1.5,"input":{"name":"a"},"output":{"name":"a","hello":"hi"}}`+"\n\n")
+		fmt.Fprint(w, `event: record`+"\n"+`data: {"id":"r2","bundle":"hello","time":"2015-07-01T00:00:01Z","elapsed":0,"skipped":true,"input":{}}`+"\n\n")
+	}))
+	defer ts.Close()
+
+	out := new(bytes.Buffer)
+	if err := ctx.Tap("tap", "hello", ts.URL, 0.5, out); err != nil {
+		t.Fatalf("Tap: got unexpected error '%v'", err)
+	}
+	if query != "bundle=hello&sample=0.5" {
+		t.Errorf("Tap: manager got query '%s'", query)
+	}
+	expected := "r1\thello\t2015-07-01T00:00:00Z\t1.5ms\n  + hello: \"hi\"\nr2\thello\t2015-07-01T00:00:01Z\t0.0ms\n  skipped\n"
+	if out.String() != expected {
+		t.Errorf("Tap: printed '%s'", out.String())
+	}
+
+	if err := ctx.Tap("missing", "hello", ts.URL, 1, out); err == nil {
+		t.Error("Tap: expected an error for a missing pipeline")
+	}
+}
+
+func TestTapUnknownBundle(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+	os.MkdirAll(ctx.PipelinePath("tap"), 0755)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "There is no bundle named 'nope'."}`, http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	if err := ctx.Tap("tap", "nope", ts.URL, 1, new(bytes.Buffer)); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Tap: got '%v' for an unknown bundle", err)
+	}
+}
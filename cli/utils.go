@@ -16,18 +16,28 @@
 package cli
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"strings"
+	"time"
 )
 
 // Useful information for the plumber CLI tool goes here
 type Context struct {
 	PipeDir       string // the directory to store plumber pipelines
 	KubeSubdir    string // the suffix to use to store kubernetes files
+	DlqSubdir     string // the suffix to use to store dead letters
+	ManagerSubdir string // the suffix to use to store the manager's config
+	RecordSubdir  string // the suffix to use to store recorded traffic
+	ShadowSubdir  string // the suffix to use to store shadow results
 	GitCommit     string // the current git commit
 	Version       string // the current version
 	ManagerImage  string // the desired image name for bootstrapping
@@ -46,9 +56,24 @@ const bootstrapDir = ".plumber-bootstrap"
 
 const k8sDir = "k8s"
 
+const dlqDir = "dlq"
+
+const managerDir = "manager"
+
+const recordDir = "recordings"
+
+const shadowDir = "shadow"
+
+// The manager reads its pipeline from this file in the manager
+// directory.
+const managerConfigFile = "pipeline.json"
+
 // The default context stores all plumber pipelines in the user's
 // home directory at ~/.plumber; all kubernetes files are stored at
-// ~/.plumber/$PIPELINE/k8s
+// ~/.plumber/$PIPELINE/k8s, dead letters at ~/.plumber/$PIPELINE/dlq,
+// the manager's config at ~/.plumber/$PIPELINE/manager, recorded
+// traffic at ~/.plumber/$PIPELINE/recordings and shadow results at
+// ~/.plumber/$PIPELINE/shadow
 //
 // It also includes some basic versioning information
 func NewDefaultContext() (*Context, error) {
@@ -61,6 +86,10 @@ func NewDefaultContext() (*Context, error) {
 	d := &Context{
 		fmt.Sprintf("%s/%s", usr.HomeDir, plumberDir),
 		k8sDir,
+		dlqDir,
+		managerDir,
+		recordDir,
+		shadowDir,
 		GitCommit,
 		versionString(),
 		"manager",
@@ -101,6 +130,34 @@ func (d *Context) KubernetesPath(name string) string {
 	return k8s
 }
 
+// Given the `name` of a pipeline, return the path where the local
+// manager should store records that fail in the pipeline
+func (d *Context) DeadLetterPath(name string) string {
+	path := d.PipelinePath(name)
+	return fmt.Sprintf("%s/%s", path, d.DlqSubdir)
+}
+
+// Given the `name` of a pipeline, return the path of the config file
+// the local manager reads its pipeline from
+func (d *Context) ManagerConfigPath(name string) string {
+	path := d.PipelinePath(name)
+	return fmt.Sprintf("%s/%s/%s", path, d.ManagerSubdir, managerConfigFile)
+}
+
+// Given the `name` of a pipeline, return the path where the local
+// manager records traffic
+func (d *Context) RecordingPath(name string) string {
+	path := d.PipelinePath(name)
+	return fmt.Sprintf("%s/%s", path, d.RecordSubdir)
+}
+
+// Given the `name` of a pipeline, return the path where the local
+// manager keeps the results of shadow traffic
+func (d *Context) ShadowPath(name string) string {
+	path := d.PipelinePath(name)
+	return fmt.Sprintf("%s/%s", path, d.ShadowSubdir)
+}
+
 // Get the manager's image name
 func (d *Context) GetManagerImage() string {
 	return d.GetImage(d.ManagerImage)
@@ -153,6 +210,81 @@ func (d *Context) GetDockerHost() (string, error) {
 	}
 }
 
+// Talks to the manager of a pipeline, using the pipeline's API key or
+// token if it has any.
+type managerClient struct {
+	*http.Client
+	url   string
+	auth  *Auth
+	admin *Auth
+}
+
+// A client for the manager at `managerUrl` if it's given, otherwise the
+// manager of the local pipeline. If the pipeline serves HTTPS, its
+// certificate is trusted.
+func (d *Context) newManagerClient(pipeline, managerUrl string, timeout time.Duration) (*managerClient, error) {
+	path, err := d.GetPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := ParsePipelineFromDir(path)
+	if err != nil {
+		return nil, err
+	}
+	client := &managerClient{Client: &http.Client{Timeout: timeout}, auth: settings.Auth, admin: settings.Admin}
+
+	scheme := "http"
+	if settings.TLS != nil {
+		scheme = "https"
+		cert, err := ioutil.ReadFile(settings.TLS.Cert)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		roots.AppendCertsFromPEM(cert)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.Transport = transport
+	}
+
+	if managerUrl != "" {
+		client.url = strings.TrimRight(managerUrl, "/")
+		return client, nil
+	}
+	hostIp, err := d.GetDockerHost()
+	if err != nil {
+		return nil, err
+	}
+	client.url = fmt.Sprintf("%s://%s:9800", scheme, hostIp)
+	return client, nil
+}
+
+// Send the pipeline's admin API key or token instead, if it has one.
+func (m *managerClient) asAdmin() {
+	if m.admin != nil {
+		m.auth = m.admin
+	}
+}
+
+// A request to `path` on the manager, with the pipeline's credentials.
+func (m *managerClient) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, m.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if m.auth != nil {
+		if len(m.auth.APIKeys) > 0 {
+			req.Header.Set("X-API-Key", m.auth.APIKeys[0])
+		} else if len(m.auth.Tokens) > 0 {
+			req.Header.Set("Authorization", "Bearer "+m.auth.Tokens[0])
+		}
+	}
+	return req, nil
+}
+
 func versionString() string {
 	versionString := version
 	if versionPrerelease != "" {
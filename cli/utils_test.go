@@ -32,6 +32,14 @@ const testBootstrapDir = "boot"
 
 const testKubeSubdir = "k8s"
 
+const testDlqSubdir = "dlq"
+
+const testManagerSubdir = "manager"
+
+const testRecordSubdir = "recordings"
+
+const testShadowSubdir = "shadow"
+
 // mock for cli context (used for testing)
 // uses temp directories
 func NewTestContext(t *testing.T) (*cli.Context, string) {
@@ -49,6 +57,10 @@ func NewTestContext(t *testing.T) (*cli.Context, string) {
 	d := &cli.Context{
 		fmt.Sprintf("%s/%s", tempDir, testPlumberDir),
 		testKubeSubdir,
+		testDlqSubdir,
+		testManagerSubdir,
+		testRecordSubdir,
+		testShadowSubdir,
 		"",
 		"test-version",
 		"manager",
@@ -115,6 +127,54 @@ func TestKubernetesPath(t *testing.T) {
 	}
 }
 
+func TestDeadLetterPath(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	expectedPath := fmt.Sprintf("%s/barbaz/dlq", ctx.PipeDir)
+
+	path := ctx.DeadLetterPath("barbaz")
+	if expectedPath != path {
+		t.Error("DeadLetterPath: did not return expected path.")
+	}
+}
+
+func TestManagerConfigPath(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	expectedPath := fmt.Sprintf("%s/barbaz/manager/pipeline.json", ctx.PipeDir)
+
+	path := ctx.ManagerConfigPath("barbaz")
+	if expectedPath != path {
+		t.Error("ManagerConfigPath: did not return expected path.")
+	}
+}
+
+func TestRecordingPath(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	expectedPath := fmt.Sprintf("%s/barbaz/recordings", ctx.PipeDir)
+
+	path := ctx.RecordingPath("barbaz")
+	if expectedPath != path {
+		t.Error("RecordingPath: did not return expected path.")
+	}
+}
+
+func TestShadowPath(t *testing.T) {
+	ctx, tempDir := NewTestContext(t)
+	defer cleanTestDir(t, tempDir)
+
+	expectedPath := fmt.Sprintf("%s/barbaz/shadow", ctx.PipeDir)
+
+	path := ctx.ShadowPath("barbaz")
+	if expectedPath != path {
+		t.Error("ShadowPath: did not return expected path.")
+	}
+}
+
 func TestDefaultContext(t *testing.T) {
 	usr, err := user.Current()
 	if err != nil {
@@ -127,7 +187,8 @@ func TestDefaultContext(t *testing.T) {
 	}
 
 	if ctx.PipeDir != fmt.Sprintf("%s/.plumber", usr.HomeDir) ||
-		ctx.KubeSubdir != "k8s" || ctx.ManagerImage != "manager" ||
+		ctx.KubeSubdir != "k8s" || ctx.DlqSubdir != "dlq" ||
+		ctx.ManagerSubdir != "manager" || ctx.RecordSubdir != "recordings" || ctx.ShadowSubdir != "shadow" || ctx.ManagerImage != "manager" ||
 		ctx.BootstrapDir != fmt.Sprintf("%s/.plumber-bootstrap", usr.HomeDir) ||
 		ctx.ImageRepo != "plumber" || ctx.DockerCmd != "docker" ||
 		ctx.DockerIface != "docker0" || ctx.DockerHostEnv != "DOCKER_HOST" ||
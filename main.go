@@ -51,7 +51,7 @@ func atLeast(num int) func(args cli.Args) bool {
 func main() {
 	plumberCtx, err := plumber.NewDefaultContext()
 	if err != nil {
-		panic(err)
+		plumber.Fail(err)
 	}
 	app := cli.NewApp()
 	app.Name = "plumber"
@@ -65,6 +65,17 @@ func main() {
 	// 		EnvVar: "LINK_SERVER",
 	// 	},
 	// }
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  plumber.LogText,
+			Usage:  "log 'text' or 'json'; bundles and managers started by plumber log the same way",
+			EnvVar: plumber.LogFormatEnv,
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		return plumber.SetLogFormat(c.GlobalString("log-format"), os.Stderr)
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "add",
@@ -74,7 +85,7 @@ func main() {
 				pipeline := c.Args()[0]
 				bundles := c.Args()[1:]
 				if err := plumberCtx.Add(pipeline, bundles...); err != nil {
-					panic(err)
+					plumber.Fail(err)
 				}
 			},
 		},
@@ -85,7 +96,7 @@ func main() {
 			Action: func(c *cli.Context) {
 				path := c.Args().First()
 				if err := plumberCtx.Create(path); err != nil {
-					panic(err)
+					plumber.Fail(err)
 				}
 			},
 		},
@@ -99,7 +110,7 @@ When running the pipeline on Google Cloud, the manager container is
 pushed to your project's private repository.`,
 			Action: func(c *cli.Context) {
 				if err := plumberCtx.Bootstrap(); err != nil {
-					panic(err)
+					plumber.Fail(err)
 				}
 			},
 		},
@@ -118,7 +129,7 @@ pushed to your project's private repository.`,
 				pipeline := c.Args().First()
 				gce := c.String("gce")
 				if err := plumberCtx.Start(pipeline, gce); err != nil {
-					panic(err)
+					plumber.Fail(err)
 				}
 			},
 		},
@@ -129,7 +140,146 @@ pushed to your project's private repository.`,
 			Action: func(c *cli.Context) {
 				path := c.Args().First()
 				if err := plumberCtx.Bundle(path); err != nil {
-					panic(err)
+					plumber.Fail(err)
+				}
+			},
+		},
+		{
+			Name:  "dlq",
+			Usage: "inspect and replay records that failed in a local pipeline",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the dead letters for a pipeline",
+					Before: createRequiredArgCheck(exactly(1), "Please provide a pipeline name."),
+					Action: func(c *cli.Context) {
+						pipeline := c.Args().First()
+						if err := plumberCtx.ListDeadLetters(pipeline); err != nil {
+							plumber.Fail(err)
+						}
+					},
+				},
+				{
+					Name:   "show",
+					Usage:  "show a single dead letter",
+					Before: createRequiredArgCheck(exactly(2), "Please provide a pipeline name and a dead letter id."),
+					Action: func(c *cli.Context) {
+						pipeline := c.Args()[0]
+						id := c.Args()[1]
+						if err := plumberCtx.ShowDeadLetter(pipeline, id); err != nil {
+							plumber.Fail(err)
+						}
+					},
+				},
+				{
+					Name:  "replay",
+					Usage: "send dead letters through the pipeline again",
+					Description: `Replays the given dead letters, or every dead letter if no ids are given,
+through a running pipeline. Records that fail in a bundle again are
+stored as new dead letters; records the manager turns away are kept.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "url",
+							Value: "",
+							Usage: "url of the manager (defaults to the local manager)",
+						},
+					},
+					Before: createRequiredArgCheck(atLeast(1), "Please provide a pipeline name."),
+					Action: func(c *cli.Context) {
+						pipeline := c.Args()[0]
+						ids := c.Args()[1:]
+						if err := plumberCtx.ReplayDeadLetters(pipeline, c.String("url"), ids...); err != nil {
+							plumber.Fail(err)
+						}
+					},
+				},
+			},
+		},
+		{
+			Name:  "replay",
+			Usage: "send recorded traffic through a running pipeline and report what changed",
+			Description: `Sends every record the manager recorded through the pipeline again and
+prints the records whose response changed. Exits with status 1 if any
+did, so it can be used to test changes to bundles.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "url of the manager (defaults to the local manager)",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Value: "",
+					Usage: "recording to replay (defaults to the pipeline's recording)",
+				},
+			},
+			Before: createRequiredArgCheck(exactly(1), "Please provide a pipeline name."),
+			Action: func(c *cli.Context) {
+				pipeline := c.Args().First()
+				changed, err := plumberCtx.Replay(pipeline, c.String("url"), c.String("file"), os.Stdout)
+				if err != nil {
+					plumber.Fail(err)
+				}
+				if changed > 0 {
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "shadow",
+			Usage: "compare bundles with the candidates they mirror records to",
+			Subcommands: []cli.Command{
+				{
+					Name:  "report",
+					Usage: "summarize how candidates' outputs differed from their bundles'",
+					Description: `Reads the results the manager kept of mirroring records to candidate
+bundles and prints, for every candidate, how many outputs matched and
+which fields were most often added, removed or changed.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "bundle",
+							Value: "",
+							Usage: "only report on this bundle's candidates",
+						},
+						cli.StringFlag{
+							Name:  "file",
+							Value: "",
+							Usage: "shadow results to read (defaults to the pipeline's)",
+						},
+					},
+					Before: createRequiredArgCheck(exactly(1), "Please provide a pipeline name."),
+					Action: func(c *cli.Context) {
+						pipeline := c.Args().First()
+						if err := plumberCtx.ShadowReport(pipeline, c.String("bundle"), c.String("file"), os.Stdout); err != nil {
+							plumber.Fail(err)
+						}
+					},
+				},
+			},
+		},
+		{
+			Name:  "tap",
+			Usage: "watch records go through a bundle of a running pipeline",
+			Description: `Prints a sample of the records a bundle is sent, along with the fields
+the bundle added, removed or changed, until interrupted.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "url of the manager (defaults to the local manager)",
+				},
+				cli.Float64Flag{
+					Name:  "sample",
+					Value: 1,
+					Usage: "fraction of records to print",
+				},
+			},
+			Before: createRequiredArgCheck(exactly(2), "Please provide a pipeline name and a bundle name."),
+			Action: func(c *cli.Context) {
+				pipeline := c.Args()[0]
+				bundle := c.Args()[1]
+				if err := plumberCtx.Tap(pipeline, bundle, c.String("url"), c.Float64("sample"), os.Stdout); err != nil {
+					plumber.Fail(err)
 				}
 			},
 		},
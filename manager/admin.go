@@ -0,0 +1,174 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type endpointStatus struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Active   int    `json:"active"` // requests in flight
+	Failures int    `json:"failures"`
+	Ejected  bool   `json:"ejected,omitempty"`
+}
+
+type stageStatusReport struct {
+	Name      string           `json:"name"`
+	Strategy  string           `json:"strategy"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+// What the admin API can change about a stage. Without `URLs`, the
+// stage keeps the urls it has.
+type stageUpdate struct {
+	URLs    []string       `json:"urls"`
+	Weights map[string]int `json:"weights"`
+}
+
+func (b *balancer) status() []endpointStatus {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	endpoints := make([]endpointStatus, len(b.endpoints))
+	for i, e := range b.endpoints {
+		endpoints[i] = endpointStatus{e.url, e.weight, e.active, e.failures, now.Before(e.ejectedUntil)}
+	}
+	return endpoints
+}
+
+// Changes the stage's endpoints. New urls mean a new version of the
+// bundle, so the results cached from the old one are dropped.
+func (s *stage) override(update stageUpdate) error {
+	before := s.balancer.urls()
+	if err := s.balancer.update(update.URLs, update.Weights); err != nil {
+		return err
+	}
+	s.balancer.Lock()
+	s.balancer.overridden = true
+	s.balancer.Unlock()
+	if !sameDefinition(before, s.balancer.urls()) {
+		s.cache.clear()
+	}
+	return nil
+}
+
+func (s *stage) status() stageStatusReport {
+	return stageStatusReport{s.Name, s.Balance.Strategy, s.balancer.status()}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Only lets requests through with one of the pipeline's admin keys or
+// tokens. Without any, there is no admin API.
+func requireAdmin(source pipelineSource, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := source.current().Admin
+		if admin == nil {
+			writeError(w, &requestError{http.StatusNotFound, "The admin API is not enabled."})
+			return
+		}
+		if !admin.allows(r) {
+			unauthorized(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Whether the request may say it's a replay of recorded traffic, which
+// is neither recorded nor stored as a dead letter. Only admins may, so
+// callers can't keep their failures out of the dead letter queue. A
+// pipeline without `auth` or `admin` can't tell its callers apart, so
+// it takes everyone's word for it.
+func (p *pipeline) trustsReplay(r *http.Request) bool {
+	if p.Admin != nil {
+		return p.Admin.allows(r)
+	}
+	return p.Auth.open()
+}
+
+// `GET /admin/stages` lists every stage and its endpoints, and `GET
+// /admin/stages/NAME` just the one. `PUT /admin/stages/NAME` swaps the
+// stage's urls or changes their weights without dropping any records.
+// Changes last until the stage's config changes.
+func createAdminHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := source.current()
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/stages"), "/")
+		if name == "" {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+			stages := []stageStatusReport{}
+			for _, s := range p.order {
+				stages = append(stages, s.status())
+			}
+			writeJSON(w, map[string][]stageStatusReport{"stages": stages})
+			return
+		}
+
+		s := p.stage(name)
+		if s == nil {
+			writeError(w, &requestError{http.StatusNotFound, fmt.Sprintf("There is no bundle named '%s'.", name)})
+			return
+		}
+		switch r.Method {
+		case "GET":
+			writeJSON(w, s.status())
+		case "PUT":
+			var update stageUpdate
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeError(w, &requestError{http.StatusBadRequest, err.Error()})
+				return
+			}
+			for _, u := range update.URLs {
+				if parsedUrl, err := url.Parse(u); err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+					writeError(w, &requestError{http.StatusBadRequest, fmt.Sprintf("'%s' is not a valid url.", u)})
+					return
+				}
+			}
+			if update.URLs != nil && len(update.URLs) == 0 {
+				writeError(w, &requestError{http.StatusBadRequest, fmt.Sprintf("Stage '%s' needs at least one url.", name)})
+				return
+			}
+			if err := s.override(update); err != nil {
+				writeError(w, &requestError{http.StatusBadRequest, err.Error()})
+				return
+			}
+			status := s.status()
+			logEvent(logFields{Pipeline: p.Name, Bundle: name}, "Stage '%s' now has endpoints %+v.", name, status.Endpoints)
+			writeJSON(w, status)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
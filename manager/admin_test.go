@@ -0,0 +1,215 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func adminRequest(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set(apiKeyHeader, "admin")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	p := newTestPipeline(t, withURLs("http://a:9800"))
+	if w := adminRequest(requireAdmin(p, createAdminHandler(p)), "GET", "/admin/stages", ""); w.Code != http.StatusNotFound {
+		t.Errorf("a pipeline without admin keys got status %d", w.Code)
+	}
+
+	p = newTestPipeline(t, withName("admin"), withSettings(`"admin": {"apiKeys": ["admin"]}`),
+		withStages(`{"name": "a", "urls": ["http://a:9800"]}`))
+	req, _ := http.NewRequest("GET", "/admin/stages", nil)
+	req.Header.Set(apiKeyHeader, "nope")
+	w := httptest.NewRecorder()
+	requireAdmin(p, createAdminHandler(p))(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a bad admin key got status %d", w.Code)
+	}
+
+	if _, err := parsePipeline([]byte(`{"stages": [], "admin": {}}`)); err == nil {
+		t.Error("expected an error for an admin API without keys")
+	}
+}
+
+// Test a blue/green swap: records in flight to the old endpoint finish,
+// and new ones go to the new endpoint.
+func TestAdminSwap(t *testing.T) {
+	blue := httptest.NewServer(http.HandlerFunc(makeEnhancer("blue", 200*time.Millisecond)))
+	defer blue.Close()
+	green := httptest.NewServer(http.HandlerFunc(makeEnhancer("green", 0)))
+	defer green.Close()
+	p := newTestPipeline(t, withName("admin"), withSettings(`"admin": {"apiKeys": ["admin"]}`),
+		withStages(`{"name": "a", "urls": [%q]}`, blue.URL))
+	handler := requireAdmin(p, createAdminHandler(p))
+
+	w := adminRequest(handler, "GET", "/admin/stages", "")
+	var list struct{ Stages []stageStatusReport }
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Stages) != 1 || list.Stages[0].Name != "a" || list.Stages[0].Endpoints[0].URL != blue.URL || list.Stages[0].Endpoints[0].Weight != 1 {
+		t.Fatalf("unexpected stages '%s'", w.Body.String())
+	}
+
+	inFlight := make(chan error)
+	go func() {
+		output, err := p.run([]byte(`{"x": 1}`), newTrace(""))
+		if err == nil && !bytes.Contains(output, []byte("blue")) {
+			err = fmt.Errorf("got '%s'", output)
+		}
+		inFlight <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	w = adminRequest(handler, "PUT", "/admin/stages/a", fmt.Sprintf(`{"urls": ["%s"]}`, green.URL))
+	var status stageStatusReport
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || len(status.Endpoints) != 1 || status.Endpoints[0].URL != green.URL {
+		t.Fatalf("swap got %d: '%s'", w.Code, w.Body.String())
+	}
+	if output, err := p.run([]byte(`{"x": 1}`), newTrace("")); err != nil || !bytes.Contains(output, []byte("green")) {
+		t.Errorf("after the swap got '%s', %v", output, err)
+	}
+	if err := <-inFlight; err != nil {
+		t.Errorf("the record in flight during the swap failed: %v", err)
+	}
+}
+
+func TestAdminWeights(t *testing.T) {
+	blue := httptest.NewServer(http.HandlerFunc(makeEnhancer("blue", 0)))
+	defer blue.Close()
+	green := httptest.NewServer(http.HandlerFunc(makeEnhancer("green", 0)))
+	defer green.Close()
+	p := newTestPipeline(t, withName("admin"), withSettings(`"admin": {"apiKeys": ["admin"]}`),
+		withStages(`{"name": "a", "urls": [%q, %q]}`, blue.URL, green.URL))
+	handler := requireAdmin(p, createAdminHandler(p))
+
+	w := adminRequest(handler, "PUT", "/admin/stages/a", fmt.Sprintf(`{"weights": {"%s": 0}}`, blue.URL))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: '%s'", w.Code, w.Body.String())
+	}
+	for i := 0; i < 4; i++ {
+		if output, err := p.run([]byte(`{"x": 1}`), newTrace("")); err != nil || !bytes.Contains(output, []byte("green")) {
+			t.Errorf("got '%s', %v", output, err)
+		}
+	}
+
+	for _, bad := range []struct {
+		stage, body string
+		status      int
+	}{
+		{"a", `{"urls": ["ftp://nope"]}`, http.StatusBadRequest},
+		{"a", `{"urls": []}`, http.StatusBadRequest},
+		{"a", fmt.Sprintf(`{"weights": {"%s": -1}}`, green.URL), http.StatusBadRequest},
+		{"a", fmt.Sprintf(`{"weights": {"%s": 0}}`, green.URL), http.StatusBadRequest},
+		{"a", `nope`, http.StatusBadRequest},
+		{"nope", `{}`, http.StatusNotFound},
+	} {
+		if w := adminRequest(handler, "PUT", "/admin/stages/"+bad.stage, bad.body); w.Code != bad.status {
+			t.Errorf("'%s' to '%s' got %d, expected %d", bad.body, bad.stage, w.Code, bad.status)
+		}
+	}
+}
+
+// an enhancer that adds its version to the record
+func makeVersionEnhancer(version string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&record)
+		record["v"] = version
+		json.NewEncoder(w).Encode(record)
+	}))
+}
+
+// Test that a swap empties the stage's cache, so cached records get the
+// new version's outputs.
+func TestAdminSwapClearsCache(t *testing.T) {
+	blue := makeVersionEnhancer("blue")
+	defer blue.Close()
+	green := makeVersionEnhancer("green")
+	defer green.Close()
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "admin", "admin": {"apiKeys": ["admin"]}, "stages": [
+		{"name": "a", "url": "%s", "inputs": ["x"], "outputs": ["v"], "cache": {"ttl": "1h"}}]}`, blue.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requireAdmin(p, createAdminHandler(p))
+	version := func() string {
+		output, err := p.run([]byte(`{"x": 1}`), newTrace(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record struct{ V string }
+		json.Unmarshal(output, &record)
+		return record.V
+	}
+
+	version()
+	if v := version(); v != "blue" {
+		t.Fatalf("got version '%s' from the cache", v)
+	}
+	if w := adminRequest(handler, "PUT", "/admin/stages/a", fmt.Sprintf(`{"urls": ["%s"]}`, green.URL)); w.Code != http.StatusOK {
+		t.Fatalf("swap got %d: '%s'", w.Code, w.Body.String())
+	}
+	if v := version(); v != "green" {
+		t.Errorf("got version '%s' after the swap", v)
+	}
+}
+
+// Test that a swap survives reloads until the stage changes in the
+// config, which is logged.
+func TestAdminSwapAndReload(t *testing.T) {
+	path, live := newTestConfig(t, "http://blue:9800")
+	defer os.RemoveAll(filepath.Dir(path))
+	s := live.current().stage("a")
+	if err := s.override(stageUpdate{URLs: []string{"http://green:9800"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	setLogFormat(logJSON, buf)
+	defer setLogFormat(logText, os.Stderr)
+
+	live.reload(path)
+	if urls := live.current().stage("a").balancer.urls(); fmt.Sprint(urls) != "[http://green:9800]" {
+		t.Errorf("a reload without changes replaced the swap with %v", urls)
+	}
+
+	writeTestConfig(t, path, "http://red:9800")
+	live.reload(path)
+	if urls := live.current().stage("a").balancer.urls(); fmt.Sprint(urls) != "[http://red:9800]" {
+		t.Errorf("a changed stage got urls %v", urls)
+	}
+	warned := false
+	for _, line := range readLogLines(t, buf) {
+		if line["level"] == "warning" && line["bundle"] == "a" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("discarding the swap wasn't logged: %s", buf.String())
+	}
+}
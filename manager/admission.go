@@ -0,0 +1,121 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// How long a record waits in the queue if we aren't told.
+const defaultQueueTimeout = 5 * time.Second
+
+// Limits how many records are in flight, either in the whole pipeline
+// or at a single stage. Records over the limit wait in a queue of at
+// most `MaxQueue` records for up to `QueueTimeout`.
+type admissionPolicy struct {
+	MaxInFlight  int    `json:"maxInFlight,omitempty"` // no limit if 0
+	MaxQueue     int    `json:"maxQueue,omitempty"`
+	QueueTimeout string `json:"queueTimeout,omitempty"`
+
+	queueTimeout time.Duration
+}
+
+func (a *admissionPolicy) init() error {
+	var err error
+	if a.queueTimeout, err = parseDuration("queueTimeout", a.QueueTimeout, defaultQueueTimeout); err != nil {
+		return err
+	}
+	if a.MaxInFlight < 0 || a.MaxQueue < 0 {
+		return fmt.Errorf("'maxInFlight' and 'maxQueue' cannot be negative.")
+	}
+	return nil
+}
+
+// The error we give when a record isn't admitted. `status` is 429 when
+// the caller should slow down and 503 when a bundle is overloaded.
+type overloadError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *overloadError) Error() string {
+	return e.message
+}
+
+// The value of the Retry-After header, in whole seconds.
+func (e *overloadError) retryAfterSeconds() string {
+	return fmt.Sprintf("%d", int(math.Max(1, math.Ceil(e.retryAfter.Seconds()))))
+}
+
+type limiter struct {
+	slots   chan struct{}
+	waiting int64
+	policy  admissionPolicy
+	status  int    // the status we give when the queue is full
+	what    string // what's overloaded, for error messages
+}
+
+// Returns nil if there's no limit; a nil limiter admits everything.
+func newLimiter(policy admissionPolicy, status int, what string) *limiter {
+	if policy.MaxInFlight == 0 {
+		return nil
+	}
+	return &limiter{
+		slots:  make(chan struct{}, policy.MaxInFlight),
+		policy: policy,
+		status: status,
+		what:   what,
+	}
+}
+
+// Waits for a slot. Every successful call must be followed by a call to
+// `release`.
+func (l *limiter) acquire() error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.waiting, 1) > int64(l.policy.MaxQueue) {
+		atomic.AddInt64(&l.waiting, -1)
+		return &overloadError{l.status, fmt.Sprintf("%s is overloaded; its queue is full", l.what), l.policy.queueTimeout}
+	}
+	defer atomic.AddInt64(&l.waiting, -1)
+
+	timer := time.NewTimer(l.policy.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &overloadError{http.StatusServiceUnavailable, fmt.Sprintf("%s is overloaded; timed out after waiting %v", l.what, l.policy.queueTimeout), l.policy.queueTimeout}
+	}
+}
+
+func (l *limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
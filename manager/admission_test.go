@@ -0,0 +1,79 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Sends two records at once and returns the status codes and
+// Retry-After headers, sorted by status.
+func postConcurrently(t *testing.T, p *pipeline) ([]int, []string) {
+	handler := createHandler(p)
+	responses := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			// make sure the first record gets there first
+			time.Sleep(time.Duration(i) * 20 * time.Millisecond)
+			responses <- post(handler, "/", `{}`)
+		}(i)
+	}
+	results := []*httptest.ResponseRecorder{<-responses, <-responses}
+	sort.Slice(results, func(i, j int) bool { return results[i].Code < results[j].Code })
+	return []int{results[0].Code, results[1].Code},
+		[]string{results[0].Header().Get("Retry-After"), results[1].Header().Get("Retry-After")}
+}
+
+func TestAdmission(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(makeEnhancer("slow", 100*time.Millisecond)))
+	defer slow.Close()
+
+	cases := []struct {
+		pipeline, stage string
+		status          int
+		retryAfter      string
+	}{
+		// the pipeline's queue is full
+		{`{"maxInFlight": 1}`, `{}`, http.StatusTooManyRequests, "5"},
+		// the record waited too long in the pipeline's queue
+		{`{"maxInFlight": 1, "maxQueue": 1, "queueTimeout": "20ms"}`, `{}`, http.StatusServiceUnavailable, "1"},
+		// the stage's queue is full
+		{`{}`, `{"maxInFlight": 1, "queueTimeout": "3s"}`, http.StatusServiceUnavailable, "3"},
+		// the record waits its turn
+		{`{"maxInFlight": 1, "maxQueue": 1}`, `{}`, http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		p := newTestPipeline(t, withName("admission"), withSettings(`"admission": %s`, c.pipeline),
+			withStages(`{"name": "slow", "url": %q, "admission": %s}`, slow.URL, c.stage))
+		codes, retryAfter := postConcurrently(t, p)
+		if codes[0] != http.StatusOK || codes[1] != c.status || retryAfter[1] != c.retryAfter {
+			t.Errorf("%s %s: expected 200 and %d with Retry-After '%s', got %v and %v", c.pipeline, c.stage, c.status, c.retryAfter, codes, retryAfter)
+		}
+	}
+}
+
+func TestAdmissionPolicyInvalid(t *testing.T) {
+	for _, admission := range []string{`{"maxInFlight": -1}`, `{"queueTimeout": "later"}`} {
+		if _, err := parsePipeline([]byte(fmt.Sprintf(`{"admission": %s, "stages": []}`, admission))); err == nil {
+			t.Errorf("expected an error for admission '%s'", admission)
+		}
+	}
+}
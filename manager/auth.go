@@ -0,0 +1,146 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// Callers must send one of `APIKeys` in the X-API-Key header or one of
+// `Tokens` as a bearer token. Without any keys or tokens, anyone can
+// send records.
+type authPolicy struct {
+	APIKeys []string `json:"apiKeys,omitempty"`
+	Tokens  []string `json:"tokens,omitempty"`
+}
+
+func (a *authPolicy) init() error {
+	for _, secret := range append(append([]string{}, a.APIKeys...), a.Tokens...) {
+		if secret == "" {
+			return fmt.Errorf("API keys and tokens cannot be empty.")
+		}
+	}
+	return nil
+}
+
+// True if the policy has no keys or tokens to check.
+func (a *authPolicy) open() bool {
+	return a == nil || (len(a.APIKeys) == 0 && len(a.Tokens) == 0)
+}
+
+func matches(secret string, allowed []string) bool {
+	found := false
+	for _, s := range allowed {
+		// compare against every secret, so how long this takes doesn't
+		// tell you anything
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// True if the request may use the pipeline. A nil policy allows
+// everything.
+func (a *authPolicy) allows(r *http.Request) bool {
+	if a.open() {
+		return true
+	}
+	if key := r.Header.Get(apiKeyHeader); key != "" && matches(key, a.APIKeys) {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return matches(strings.TrimSpace(auth[7:]), a.Tokens)
+	}
+	return false
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="plumber"`)
+	writeError(w, &requestError{http.StatusUnauthorized, "Missing or invalid API key or bearer token."})
+}
+
+// Only lets requests through if the current pipeline's auth policy
+// allows them. Admins may use the pipeline too.
+func requireAuth(source pipelineSource, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := source.current()
+		if !p.Auth.allows(r) && !(p.Admin != nil && p.Admin.allows(r)) {
+			unauthorized(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// How the manager connects to enhancers with https urls. `CA` is the
+// certificate authority that signed the enhancers' certificates; if it
+// isn't set, the system's are used. With a `Cert` and `Key`, the
+// manager presents a client certificate, for enhancers that require
+// mutual TLS. The files are read when the pipeline is loaded.
+type tlsPolicy struct {
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+func (t *tlsPolicy) config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("'%s' does not have any PEM certificates.", t.CA)
+		}
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, fmt.Errorf("Both a 'cert' and a 'key' are needed for a client certificate.")
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// The transport for requests to enhancers; nil means the default.
+func (t *tlsPolicy) transport() (http.RoundTripper, error) {
+	if t == nil {
+		return nil, nil
+	}
+	config, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, nil
+}
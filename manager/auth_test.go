@@ -0,0 +1,214 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for 127.0.0.1, good for both servers
+// and clients, and returns the paths to it and its key.
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "plumber"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cert, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, keyFile
+}
+
+func TestAuth(t *testing.T) {
+	p, err := parsePipeline([]byte(`{"name": "auth", "stages": [], "auth": {"apiKeys": ["key"], "tokens": ["token"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requireAuth(p, createHandler(p))
+	for headers, status := range map[[2]string]int{
+		{}:                                  http.StatusUnauthorized,
+		{apiKeyHeader, "key"}:               http.StatusOK,
+		{apiKeyHeader, "nope"}:              http.StatusUnauthorized,
+		{apiKeyHeader, "token"}:             http.StatusUnauthorized,
+		{"Authorization", "Bearer token"}:   http.StatusOK,
+		{"Authorization", "bearer token"}:   http.StatusOK,
+		{"Authorization", "Bearer key"}:     http.StatusUnauthorized,
+		{"Authorization", "Basic dG9rZW4="}: http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"x": 1}`))
+		if headers[0] != "" {
+			req.Header.Set(headers[0], headers[1])
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != status {
+			t.Errorf("%v got status %d, expected %d", headers, w.Code, status)
+		}
+		if status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%v did not get a WWW-Authenticate header", headers)
+		}
+	}
+}
+
+func TestAuthAdmin(t *testing.T) {
+	p, err := parsePipeline([]byte(`{"name": "auth", "stages": [], "auth": {"apiKeys": ["key"]}, "admin": {"tokens": ["admin"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"x": 1}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	requireAuth(p, createHandler(p))(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("an admin got status %d", w.Code)
+	}
+}
+
+func TestAuthOpenByDefault(t *testing.T) {
+	p := newTestPipeline(t)
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"x": 1}`))
+	w := httptest.NewRecorder()
+	requireAuth(p, createHandler(p))(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("a pipeline without auth got status %d", w.Code)
+	}
+}
+
+func TestAuthInvalid(t *testing.T) {
+	if _, err := parsePipeline([]byte(`{"stages": [], "auth": {"tokens": [""]}}`)); err == nil {
+		t.Error("expected an error for an empty token")
+	}
+}
+
+// Test that the manager presents its client certificate to an enhancer
+// that requires one.
+func TestEnhancerTLS(t *testing.T) {
+	cert, key := writeTestCert(t)
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(pair.Leaf)
+
+	enhancer := makeEnhancer("a", 0)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info" {
+			return
+		}
+		enhancer(w, r)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := func(tlsConfig string) []byte {
+		return []byte(fmt.Sprintf(`{"name": "tls", "stages": [{"name": "a", "url": "%s"}]%s}`, ts.URL, tlsConfig))
+	}
+	p, err := parsePipeline(config(fmt.Sprintf(`, "enhancerTLS": {"ca": "%s", "cert": "%s", "key": "%s"}`, cert, cert, key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := p.run([]byte(`{"x": 1}`), newTrace("")); err != nil || string(bytes.TrimSpace(output)) != `{"a":"a saw 1 fields","x":1}` {
+		t.Errorf("got '%s', %v", output, err)
+	}
+	if report := p.health(); !report.Ready {
+		t.Errorf("the enhancer should be reachable: %+v", report)
+	}
+
+	// without a client certificate, the enhancer turns us away
+	p, err = parsePipeline(config(fmt.Sprintf(`, "enhancerTLS": {"ca": "%s"}`, cert)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.run([]byte(`{"x": 1}`), newTrace("")); err == nil {
+		t.Error("expected an error without a client certificate")
+	}
+
+	if _, err := parsePipeline(config(fmt.Sprintf(`, "enhancerTLS": {"cert": "%s"}`, cert))); err == nil {
+		t.Error("expected an error for a cert without a key")
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	cert, key := writeTestCert(t)
+	if _, err := listenTLS(nil, cert, ""); err == nil {
+		t.Error("expected an error for a cert without a key")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener, err = listenTLS(listener, cert, key); err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(createHealthzHandler(newTestPipeline(t)))}
+	go server.Serve(listener)
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	data, _ := ioutil.ReadFile(cert)
+	pool.AppendCertsFromPEM(data)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d over HTTPS", resp.StatusCode)
+	}
+}
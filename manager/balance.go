@@ -0,0 +1,244 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How records are spread over a stage's endpoints.
+const (
+	balanceRoundRobin       = "round-robin"       // take turns
+	balanceLeastConnections = "least-connections" // pick the endpoint with the fewest requests in flight
+)
+
+// An endpoint is ejected after this many consecutive failures, for
+// this long, unless the stage says otherwise.
+const (
+	defaultEjectFailures = 3
+	defaultEjectCooldown = 10 * time.Second
+)
+
+// How the manager balances a stage with several `urls`. An endpoint
+// that fails `Failures` times in a row (connection errors, timeouts and
+// 5xx responses) is ejected for `Cooldown`. If every endpoint has been
+// ejected, they are all used anyway. `Weights` gives some endpoints a
+// bigger share of the records than others (1 by default); an endpoint
+// with a weight of 0 isn't sent any.
+type balancePolicy struct {
+	Strategy string         `json:"strategy,omitempty"`
+	Failures int            `json:"failures,omitempty"`
+	Cooldown string         `json:"cooldown,omitempty"`
+	Weights  map[string]int `json:"weights,omitempty"`
+
+	cooldown time.Duration
+}
+
+func (b *balancePolicy) init() error {
+	switch b.Strategy {
+	case "":
+		b.Strategy = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastConnections:
+	default:
+		return fmt.Errorf("'strategy' must be '%s' or '%s', not '%s'.", balanceRoundRobin, balanceLeastConnections, b.Strategy)
+	}
+	if b.Failures < 0 {
+		return fmt.Errorf("'%d' is not a valid number of failures.", b.Failures)
+	}
+	if b.Failures == 0 {
+		b.Failures = defaultEjectFailures
+	}
+	var err error
+	b.cooldown, err = parseDuration("cooldown", b.Cooldown, defaultEjectCooldown)
+	return err
+}
+
+type endpoint struct {
+	url          string
+	weight       int
+	current      int       // for smooth weighted round-robin
+	active       int       // requests in flight
+	failures     int       // consecutive failures
+	ejectedUntil time.Time // when we will use the endpoint again
+}
+
+// Picks the endpoint for each request to a stage. It is shared by every
+// request going through the stage.
+type balancer struct {
+	sync.Mutex
+	stage      string
+	policy     balancePolicy
+	endpoints  []*endpoint
+	next       int  // where least-connections starts looking
+	overridden bool // true once the admin API has changed the endpoints
+}
+
+func newBalancer(stage string, urls []string, policy balancePolicy) (*balancer, error) {
+	b := &balancer{stage: stage, policy: policy}
+	if err := b.update(urls, policy.Weights); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Replaces the endpoints with `urls` (unless it's nil) and changes
+// their `weights`. Endpoints that are kept hang on to their weight and
+// state, and requests already sent to an endpoint that's removed still
+// finish, so nothing is dropped.
+func (b *balancer) update(urls []string, weights map[string]int) error {
+	b.Lock()
+	defer b.Unlock()
+	existing := make(map[string]*endpoint)
+	for _, e := range b.endpoints {
+		existing[e.url] = e
+	}
+	if urls == nil {
+		urls = b.urlsLocked()
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("Stage '%s' needs at least one url.", b.stage)
+	}
+
+	seen := make(map[string]bool)
+	total := 0
+	endpoints := make([]*endpoint, len(urls))
+	for i, u := range urls {
+		if seen[u] {
+			return fmt.Errorf("Stage '%s' has '%s' more than once.", b.stage, u)
+		}
+		seen[u] = true
+		weight := 1
+		if e, ok := existing[u]; ok {
+			weight = e.weight
+		}
+		if w, ok := weights[u]; ok {
+			weight = w
+		}
+		if weight < 0 {
+			return fmt.Errorf("'%d' is not a valid weight for '%s'.", weight, u)
+		}
+		total += weight
+		endpoints[i] = &endpoint{url: u, weight: weight}
+	}
+	for u := range weights {
+		if !seen[u] {
+			return fmt.Errorf("Stage '%s' does not have a url '%s' to weigh.", b.stage, u)
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("Stage '%s' needs a url with a weight above 0.", b.stage)
+	}
+
+	for i, e := range endpoints {
+		if old, ok := existing[e.url]; ok {
+			old.weight = e.weight
+			endpoints[i] = old
+		}
+	}
+	b.endpoints = endpoints
+	b.next = 0
+	return nil
+}
+
+// Picks an endpoint for a request. Every call must be followed by a
+// call to `done`.
+func (b *balancer) pick() *endpoint {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	usable := func(e *endpoint) bool {
+		return e.weight > 0 && !now.Before(e.ejectedUntil)
+	}
+	allEjected := true
+	for _, e := range b.endpoints {
+		if usable(e) {
+			allEjected = false
+		}
+	}
+	eligible := func(e *endpoint) bool {
+		return e.weight > 0 && (allEjected || usable(e))
+	}
+
+	var best *endpoint
+	if b.policy.Strategy == balanceRoundRobin {
+		// smooth weighted round-robin: every endpoint earns its weight,
+		// and the richest pays everyone else's share
+		total := 0
+		for _, e := range b.endpoints {
+			if !eligible(e) {
+				continue
+			}
+			e.current += e.weight
+			total += e.weight
+			if best == nil || e.current > best.current {
+				best = e
+			}
+		}
+		best.current -= total
+	} else {
+		// start after the endpoint we picked last time, so that ties
+		// take turns
+		for k := range b.endpoints {
+			i := (b.next + k) % len(b.endpoints)
+			e := b.endpoints[i]
+			if !eligible(e) {
+				continue
+			}
+			// fewest requests in flight for its weight
+			if best == nil || e.active*best.weight < best.active*e.weight {
+				best = e
+				b.next = i + 1
+			}
+		}
+	}
+	best.active++
+	return best
+}
+
+// Records how a request to the endpoint went, ejecting the endpoint if
+// it has failed too often.
+func (b *balancer) done(e *endpoint, err error) {
+	b.Lock()
+	defer b.Unlock()
+	e.active--
+	if !retryable(err) {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if e.failures >= b.policy.Failures && len(b.endpoints) > 1 {
+		e.ejectedUntil = time.Now().Add(b.policy.cooldown)
+		e.failures = 0
+		logEvent(logFields{Bundle: b.stage, Err: err}, "Ejecting '%s' from stage '%s' for %v.", e.url, b.stage, b.policy.cooldown)
+	}
+}
+
+// The urls of the endpoints.
+func (b *balancer) urls() []string {
+	b.Lock()
+	defer b.Unlock()
+	return b.urlsLocked()
+}
+
+func (b *balancer) urlsLocked() []string {
+	urls := make([]string, len(b.endpoints))
+	for i, e := range b.endpoints {
+		urls[i] = e.url
+	}
+	return urls
+}
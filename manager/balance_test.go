@@ -0,0 +1,190 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestBalancer(t *testing.T, strategy string, urls ...string) *balancer {
+	policy := balancePolicy{Strategy: strategy, Failures: 2, Cooldown: "1h"}
+	if err := policy.init(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBalancer("test", urls, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newTestBalancer(t, balanceRoundRobin, "a", "b", "c")
+	picked := ""
+	for i := 0; i < 6; i++ {
+		e := b.pick()
+		picked += e.url
+		b.done(e, nil)
+	}
+	if picked != "abcabc" {
+		t.Errorf("round-robin picked '%s'", picked)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := newTestBalancer(t, balanceLeastConnections, "a", "b", "c")
+	a, bb := b.pick(), b.pick()
+	b.done(a, nil)
+	// 'a' and 'c' are idle; we take turns, so 'c' is next
+	if e := b.pick(); e.url != "c" {
+		t.Errorf("least-connections picked '%s'", e.url)
+	}
+	if e := b.pick(); e.url != "a" {
+		t.Errorf("least-connections picked '%s'", e.url)
+	}
+	b.done(bb, nil)
+	if e := b.pick(); e.url != "b" {
+		t.Errorf("least-connections picked '%s'", e.url)
+	}
+}
+
+func TestBalancerEjects(t *testing.T) {
+	b := newTestBalancer(t, balanceRoundRobin, "a", "b")
+	oops := errors.New("oops")
+	for i := 0; i < 2; i++ {
+		a := b.pick()
+		b.done(a, oops)
+		b.done(b.pick(), nil)
+	}
+	for i := 0; i < 3; i++ {
+		e := b.pick()
+		if e.url != "b" {
+			t.Errorf("picked ejected endpoint '%s'", e.url)
+		}
+		b.done(e, &enhancerError{400, "rejected records don't count"})
+	}
+
+	// if every endpoint is ejected, we use them anyway
+	for i := 0; i < 2; i++ {
+		b.done(b.pick(), oops)
+	}
+	if e := b.pick(); e.url != "a" && e.url != "b" {
+		t.Errorf("picked '%s'", e.url)
+	}
+}
+
+func TestStageBalancesReplicas(t *testing.T) {
+	var calls [2]int32
+	replicas := make([]*httptest.Server, 2)
+	for i := range replicas {
+		i := i
+		replicas[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls[i], 1)
+			w.Write([]byte(`{}`))
+		}))
+		defer replicas[i].Close()
+	}
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "replicas", "stages": [
+		{"name": "a", "urls": ["%s", "%s", "%s"], "balance": {"failures": 1, "cooldown": "1h"},
+		 "policy": {"idempotent": true, "retries": 1, "backoff": "1ms"}}]}`,
+		replicas[0].URL, down.URL, replicas[1].URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := p.run([]byte(`{}`), nil); err != nil {
+			t.Fatalf("record %d failed: %v", i, err)
+		}
+	}
+	if calls[0]+calls[1] != 10 || calls[0] < 4 || calls[1] < 4 {
+		t.Errorf("replicas got %v records", calls)
+	}
+
+	report := p.health()
+	if !report.Ready || len(report.Stages) != 3 || report.Stages[1].OK {
+		t.Errorf("unexpected health report %+v", report)
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	for _, strategy := range []string{balanceRoundRobin, balanceLeastConnections} {
+		policy := balancePolicy{Strategy: strategy, Weights: map[string]int{"a": 2, "c": 0}}
+		if err := policy.init(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := newBalancer("test", []string{"a", "b", "c"}, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked := make(map[string]int)
+		var endpoints []*endpoint
+		for i := 0; i < 6; i++ {
+			e := b.pick()
+			picked[e.url]++
+			endpoints = append(endpoints, e)
+			if strategy == balanceRoundRobin {
+				b.done(e, nil)
+			}
+		}
+		if picked["a"] != 4 || picked["b"] != 2 || picked["c"] != 0 {
+			t.Errorf("%s picked %v", strategy, picked)
+		}
+	}
+}
+
+func TestBalancerUpdate(t *testing.T) {
+	b := newTestBalancer(t, balanceRoundRobin, "a", "b")
+	inFlight := b.pick()
+
+	// swap 'b' for 'c', and take 'a' out of rotation
+	if err := b.update([]string{"a", "c"}, map[string]int{"a": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if e := b.pick(); e.url != "c" {
+		t.Errorf("picked '%s' after the update", e.url)
+	}
+	// the request already sent to 'a' still finishes
+	b.done(inFlight, nil)
+	if status := b.status(); status[0].Active != 0 || status[1].Active != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	for _, bad := range []struct {
+		urls    []string
+		weights map[string]int
+	}{
+		{[]string{}, nil},
+		{[]string{"a", "a"}, nil},
+		{nil, map[string]int{"a": -1}},
+		{nil, map[string]int{"nope": 1}},
+		{nil, map[string]int{"c": 0}},
+	} {
+		if err := b.update(bad.urls, bad.weights); err == nil {
+			t.Errorf("expected an error for %v", bad)
+		}
+	}
+	if urls := b.urls(); fmt.Sprint(urls) != "[a c]" {
+		t.Errorf("a bad update changed the urls to %v", urls)
+	}
+}
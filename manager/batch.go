@@ -0,0 +1,263 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// The number of records from a batch or stream that are sent through
+// the pipeline at once, unless the pipeline says otherwise.
+const defaultConcurrency = 8
+
+type recordResult struct {
+	output  []byte
+	err     error
+	skipped []string // the bundles the record skipped
+}
+
+func (p *pipeline) concurrency() int {
+	if p.Concurrency > 0 {
+		return p.Concurrency
+	}
+	return defaultConcurrency
+}
+
+// Runs the records returned by `next` through the pipeline, with a
+// bounded number in flight, and calls `emit` with each result in the
+// same order the records were read. `next` returns io.EOF when there
+// are no more records. The n-th record is sent to the enhancers with
+// the request id `id-n`.
+func (p *pipeline) runOrdered(id string, next func() ([]byte, error), emit func(result recordResult) error) error {
+	limit := p.concurrency()
+	inFlight := make(chan struct{}, limit)
+	pending := make(chan chan recordResult, limit)
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(pending)
+		for n := 0; ; n++ {
+			record, err := next()
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+
+			result := make(chan recordResult, 1)
+			select {
+			case inFlight <- struct{}{}:
+			case <-stop:
+				return
+			}
+			t := newTrace(fmt.Sprintf("%s-%d", id, n))
+			go func() {
+				defer func() { <-inFlight }()
+				if err := p.limiter.acquire(); err != nil {
+					result <- recordResult{nil, err, nil}
+					return
+				}
+				output, err := p.run(record, t)
+				p.limiter.release()
+				result <- recordResult{output, err, t.skippedBundles()}
+			}()
+			select {
+			case pending <- result:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var emitErr error
+	for result := range pending {
+		r := <-result
+		if emitErr == nil {
+			if emitErr = emit(r); emitErr != nil {
+				close(stop)
+			}
+		}
+	}
+	if emitErr != nil {
+		return emitErr
+	}
+	select {
+	case err := <-readErr:
+		if reqErr, ok := err.(*requestError); ok {
+			return reqErr
+		}
+		return &requestError{http.StatusBadRequest, err.Error()}
+	default:
+		return nil
+	}
+}
+
+// We write results while we're still reading records, so the server
+// must not discard the rest of the request when we start responding.
+func enableFullDuplex(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		log.Printf("Could not enable full duplex: %v", err)
+	}
+}
+
+// Formats a result so that it fits on a single line.
+func resultLine(r recordResult) []byte {
+	if r.err != nil {
+		logRequestError(r.err)
+		_, body := errorJSON(r.err, r.skipped)
+		return body
+	}
+	buf := new(bytes.Buffer)
+	if json.Compact(buf, r.output) != nil {
+		return bytes.TrimSpace(r.output)
+	}
+	return buf.Bytes()
+}
+
+// Accepts a JSON array of records and responds with a JSON array of
+// the results, in order. Records that fail are replaced with the error
+// response we would have given for that record alone.
+func createBatchHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		defer r.Body.Close()
+		p := source.current()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		decoder := json.NewDecoder(r.Body)
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			writeError(w, &requestError{http.StatusBadRequest, "Expected a JSON array of records."})
+			return
+		}
+		next := func() ([]byte, error) {
+			if !decoder.More() {
+				return nil, io.EOF
+			}
+			var record json.RawMessage
+			if err := decoder.Decode(&record); err != nil {
+				return nil, err
+			}
+			if int64(len(record)) > p.Limits.Request {
+				return nil, tooLarge("a record", p.Limits.Request)
+			}
+			return record, nil
+		}
+
+		enableFullDuplex(w)
+		w.Header().Set("Content-Type", "application/json")
+		flusher, _ := w.(http.Flusher)
+		started := false
+		emit := func(r recordResult) error {
+			separator := ",\n"
+			if !started {
+				separator = "["
+				started = true
+			}
+			if _, err := w.Write([]byte(separator)); err != nil {
+				return err
+			}
+			if _, err := w.Write(resultLine(r)); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		if err := p.runOrdered(id, next, emit); err != nil {
+			if _, ok := err.(*requestError); !ok {
+				log.Printf("%v", err)
+				return
+			}
+			emit(recordResult{err: err})
+		}
+		if !started {
+			w.Write([]byte("["))
+		}
+		w.Write([]byte("]\n"))
+	}
+}
+
+// Accepts newline-delimited JSON records and streams back the results
+// in the same format and order.
+func createStreamHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		defer r.Body.Close()
+		p := source.current()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), int(p.Limits.Request)+1)
+		next := func() ([]byte, error) {
+			for scanner.Scan() {
+				line := bytes.TrimSpace(scanner.Bytes())
+				if int64(len(line)) > p.Limits.Request {
+					return nil, tooLarge("a record", p.Limits.Request)
+				}
+				if len(line) > 0 {
+					// the scanner reuses its buffer
+					return append([]byte(nil), line...), nil
+				}
+			}
+			if err := scanner.Err(); err == bufio.ErrTooLong {
+				return nil, tooLarge("a record", p.Limits.Request)
+			} else if err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+
+		enableFullDuplex(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		emit := func(r recordResult) error {
+			line := append(resultLine(r), '\n')
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		if err := p.runOrdered(id, next, emit); err != nil {
+			if _, ok := err.(*requestError); !ok {
+				log.Printf("%v", err)
+				return
+			}
+			emit(recordResult{err: err})
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an enhancer that takes longer for smaller values of `n`, fails when
+// `n` is 0 and keeps track of the most requests it handled at once
+func makeBatchEnhancer(inFlight, maxInFlight *int32) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(inFlight, 1)
+		defer atomic.AddInt32(inFlight, -1)
+		for {
+			max := atomic.LoadInt32(maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(maxInFlight, max, current) {
+				break
+			}
+		}
+
+		var record struct{ N int }
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if record.N == 0 {
+			http.Error(w, "n must not be 0", 400)
+			return
+		}
+		time.Sleep(time.Duration(10-record.N) * 5 * time.Millisecond)
+		fmt.Fprintf(w, "{\n  \"n\": %d, \"double\": %d\n}", record.N, 2*record.N)
+	}
+}
+
+func newBatchEnhancer() (*httptest.Server, *int32) {
+	var inFlight, maxInFlight int32
+	return httptest.NewServer(http.HandlerFunc(makeBatchEnhancer(&inFlight, &maxInFlight))), &maxInFlight
+}
+
+func TestBatch(t *testing.T) {
+	enhancer, maxInFlight := newBatchEnhancer()
+	defer enhancer.Close()
+	p := newTestPipeline(t, withSettings(`"concurrency": 3`), withStages(`{"name": "double", "url": %q}`, enhancer.URL))
+
+	w := post(createBatchHandler(p), "/batch", `[{"n": 1}, {"n": 9}, {"n": 0}, {"n": 5}, {"n": 7}, {"n": 2}]`)
+	expected := `[{"n":1,"double":2},
+{"n":9,"double":18},
+{"error":{"bundle":"double","status":400,"message":"n must not be 0","record":{"n":0}}},
+{"n":5,"double":10},
+{"n":7,"double":14},
+{"n":2,"double":4}]
+`
+	if w.Code != 200 || w.Body.String() != expected {
+		t.Errorf("Batch: got %d '%s'", w.Code, w.Body.String())
+	}
+	if max := atomic.LoadInt32(maxInFlight); max > 3 {
+		t.Errorf("Batch: %d records were in flight at once", max)
+	}
+
+	w = post(createBatchHandler(p), "/batch", `[]`)
+	if w.Code != 200 || w.Body.String() != "[]\n" {
+		t.Errorf("Batch: got %d '%s' for an empty batch", w.Code, w.Body.String())
+	}
+
+	w = post(createBatchHandler(p), "/batch", `{"n": 1}`)
+	if w.Code != 400 {
+		t.Errorf("Batch: expected a 400 for a record that isn't in an array, got %d", w.Code)
+	}
+}
+
+func TestStream(t *testing.T) {
+	enhancer, maxInFlight := newBatchEnhancer()
+	defer enhancer.Close()
+	p := newTestPipeline(t, withSettings(`"concurrency": 2`), withStages(`{"name": "double", "url": %q}`, enhancer.URL))
+
+	records := []string{}
+	expected := []string{}
+	for i := 0; i < 50; i++ {
+		n := i%9 + 1
+		records = append(records, fmt.Sprintf(`{"n": %d}`, n))
+		expected = append(expected, fmt.Sprintf(`{"n":%d,"double":%d}`, n, 2*n))
+	}
+
+	w := post(createStreamHandler(p), "/stream", strings.Join(records, "\n\n")+"\n")
+	if w.Code != 200 || w.Body.String() != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("Stream: got %d '%s'", w.Code, w.Body.String())
+	}
+	if max := atomic.LoadInt32(maxInFlight); max > 2 {
+		t.Errorf("Stream: %d records were in flight at once", max)
+	}
+}
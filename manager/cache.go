@@ -0,0 +1,199 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many results a cache keeps if the bundle doesn't say.
+const defaultCacheSize = 1000
+
+// A bundle whose outputs only depend on its declared inputs can ask us
+// to cache its results. We then skip the bundle for records whose
+// inputs we've already seen.
+type cachePolicy struct {
+	TTL  string `json:"ttl"`
+	Size int    `json:"size,omitempty"` // the most results we keep
+
+	ttl time.Duration
+}
+
+func (c *cachePolicy) init() error {
+	var err error
+	if c.ttl, err = parseDuration("ttl", c.TTL, 0); err != nil {
+		return err
+	}
+	if c.ttl <= 0 {
+		return fmt.Errorf("The cache needs a 'ttl'.")
+	}
+	if c.Size < 0 {
+		return fmt.Errorf("'%d' is not a valid cache size.", c.Size)
+	}
+	if c.Size == 0 {
+		c.Size = defaultCacheSize
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key     string
+	outputs fields
+	expires time.Time
+}
+
+// A least recently used cache of a bundle's outputs, keyed on the
+// values of its inputs.
+type resultCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	size       int
+	entries    map[string]*list.Element
+	recent     *list.List // most recently used at the front
+	generation uint64     // bumped when the cache is cleared
+}
+
+func newResultCache(policy *cachePolicy) *resultCache {
+	if policy == nil {
+		return nil
+	}
+	return &resultCache{
+		ttl:     policy.ttl,
+		size:    policy.Size,
+		entries: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+func (c *resultCache) get(key string) (fields, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.recent.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.recent.MoveToFront(element)
+	return entry.outputs, true
+}
+
+// Forgets every result, for when the stage is sent to a different
+// version of the bundle. Results of requests that were in flight are
+// stored under the old generation, so they're never found.
+func (c *resultCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.recent.Init()
+	c.generation++
+}
+
+func (c *resultCache) currentGeneration() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+func (c *resultCache) put(key string, outputs fields) {
+	c.Lock()
+	defer c.Unlock()
+	entry := &cacheEntry{key, outputs, time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// The cache key for a record is its declared inputs, in order. Records
+// that are missing an input aren't cached, since the bundle will reject
+// them anyway.
+func (s *stage) cacheKey(record fields) (string, bool) {
+	key := new(bytes.Buffer)
+	for _, name := range s.Inputs {
+		value, ok := record[name]
+		if !ok {
+			return "", false
+		}
+		key.Write(value)
+		key.WriteByte('\n')
+	}
+	return key.String(), true
+}
+
+// Looks up the record in the stage's cache. `cacheable` is false if the
+// record can't be cached. On a hit, `output` is the record with the
+// cached outputs added, as the bundle would have given us; on a miss,
+// it's nil and the bundle's outputs should be stored under `key`.
+func (s *stage) cached(record []byte) (key string, output []byte, cacheable bool) {
+	if s.cache == nil {
+		return "", nil, false
+	}
+	f, err := decodeFields(record)
+	if err != nil {
+		return "", nil, false
+	}
+	if key, cacheable = s.cacheKey(f); !cacheable {
+		return "", nil, false
+	}
+	key = fmt.Sprintf("%d\n%s", s.cache.currentGeneration(), key)
+	outputs, hit := s.cache.get(key)
+	s.metrics.cached(hit)
+	if !hit {
+		return key, nil, true
+	}
+	for name, value := range outputs {
+		f[name] = value
+	}
+	if output, err = json.Marshal(f); err != nil {
+		return key, nil, true
+	}
+	return key, output, true
+}
+
+// Stores the declared outputs of the bundle's response.
+func (s *stage) store(key string, output []byte) {
+	f, err := decodeFields(output)
+	if err != nil {
+		return
+	}
+	outputs := make(fields)
+	for _, name := range s.Outputs {
+		if value, ok := f[name]; ok {
+			outputs[name] = value
+		}
+	}
+	s.cache.put(key, outputs)
+}
@@ -0,0 +1,106 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An enhancer that greets `name` and counts how often it's called.
+func makeCountingEnhancer(calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		record := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&record)
+		if name, ok := record["name"]; ok {
+			record["hello"] = fmt.Sprintf("hello, %v", name)
+		} else {
+			record["hello"] = "hello, nobody"
+		}
+		json.NewEncoder(w).Encode(record)
+	}))
+}
+
+func TestCache(t *testing.T) {
+	var calls int32
+	ts := makeCountingEnhancer(&calls)
+	defer ts.Close()
+	p := newTestPipeline(t, withName("cache"), withStages(`{"name": "hello", "url": %q,
+		"inputs": ["name"], "outputs": ["hello"], "cache": {"ttl": "1m"}}`, ts.URL))
+	// the registry outlives the test, so only count what this run adds
+	m := registry.stage("cache", "hello")
+	m.Lock()
+	hits, misses := m.cacheHits, m.cacheMisses
+	m.Unlock()
+
+	expect := func(record, expected string, expectedCalls int32) {
+		output, err := p.run([]byte(record), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != expected {
+			t.Errorf("expected '%s', got '%s'", expected, output)
+		}
+		if n := atomic.LoadInt32(&calls); n != expectedCalls {
+			t.Errorf("expected %d calls to the bundle, got %d", expectedCalls, n)
+		}
+	}
+	expect(`{"name": "a", "x": 1}`, `{"hello":"hello, a","name":"a","x":1}`+"\n", 1)
+	// the other fields come from the record, not the cache
+	expect(`{"name": "a", "x": 2}`, `{"hello":"hello, a","name":"a","x":2}`, 1)
+	expect(`{"name": "b"}`, `{"hello":"hello, b","name":"b"}`+"\n", 2)
+	// records without the inputs aren't cached
+	expect(`{}`, `{"hello":"hello, nobody"}`+"\n", 3)
+	expect(`{}`, `{"hello":"hello, nobody"}`+"\n", 4)
+
+	m.Lock()
+	defer m.Unlock()
+	if m.cacheHits-hits != 1 || m.cacheMisses-misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %d and %d", m.cacheHits-hits, m.cacheMisses-misses)
+	}
+}
+
+func TestCacheExpiresAndEvicts(t *testing.T) {
+	c := newResultCache(&cachePolicy{Size: 2, ttl: 50 * time.Millisecond})
+	c.put("a", fields{"x": []byte("1")})
+	c.put("b", fields{"x": []byte("2")})
+	c.get("a")
+	c.put("c", fields{"x": []byte("3")})
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used entry was evicted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("c"); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestCachePolicyInvalid(t *testing.T) {
+	for _, cache := range []string{`{}`, `{"ttl": "1m", "size": -1}`, `{"ttl": "soon"}`} {
+		if _, err := parsePipeline([]byte(fmt.Sprintf(`{"stages": [{"name": "a", "url": "http://a:9800", "cache": %s}]}`, cache))); err == nil {
+			t.Errorf("expected an error for cache '%s'", cache)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How often we check whether the config file has changed.
+const configPollInterval = 2 * time.Second
+
+// Handlers get the pipeline from a source when a request comes in, so
+// a request keeps using the same pipeline even if it is replaced while
+// the request is in flight.
+type pipelineSource interface {
+	current() *pipeline
+}
+
+func (p *pipeline) current() *pipeline {
+	return p
+}
+
+// A pipeline that can be replaced while the manager is running.
+type livePipeline struct {
+	value atomic.Value
+}
+
+func newLivePipeline(p *pipeline) *livePipeline {
+	live := &livePipeline{}
+	live.value.Store(p)
+	return live
+}
+
+func (live *livePipeline) current() *pipeline {
+	return live.value.Load().(*pipeline)
+}
+
+func (live *livePipeline) replace(p *pipeline) {
+	live.value.Store(p)
+}
+
+// Reads a JSON description of the pipeline from a file.
+func loadConfig(path string) (*pipeline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePipeline(data)
+}
+
+func logPipeline(p *pipeline) {
+	for _, s := range p.order {
+		logEvent(logFields{Pipeline: p.Name, Bundle: s.Name}, "Stage '%s' at %v depends on %v.", s.Name, s.balancer.urls(), s.Depends)
+	}
+}
+
+// True if `a` and `b` are configured the same way.
+func sameDefinition(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// Takes over the state of whatever `old` has that is configured the
+// same way, so that reloading the config doesn't reset breakers,
+// caches or ejected endpoints. Admission limiters are shared even if
+// the rest of the stage changed: records still in flight on the old
+// pipeline have to count against the new one's limits.
+func (p *pipeline) inherit(old *pipeline) {
+	if sameDefinition(p.Admission, old.Admission) {
+		p.limiter = old.limiter
+	}
+	for _, s := range p.Stages {
+		previous := old.stage(s.Name)
+		if previous == nil {
+			continue
+		}
+		if sameDefinition(s.Admission, previous.Admission) {
+			s.limiter = previous.limiter
+		}
+		if sameDefinition(s, previous) {
+			s.breaker, s.cache, s.balancer = previous.breaker, previous.cache, previous.balancer
+			continue
+		}
+		previous.balancer.Lock()
+		overridden := previous.balancer.overridden
+		previous.balancer.Unlock()
+		if overridden {
+			logEvent(logFields{Level: "warning", Pipeline: p.Name, Bundle: s.Name},
+				"Stage '%s' changed in the config, so the endpoints set through the admin API are replaced by %v.", s.Name, s.balancer.urls())
+		}
+	}
+}
+
+// Loads the config file and, if it's valid, replaces the live pipeline
+// with it. An invalid config leaves the running pipeline alone. Stages
+// that didn't change keep their state.
+func (live *livePipeline) reload(path string) {
+	p, err := loadConfig(path)
+	if err != nil {
+		logEvent(logFields{Err: err}, "Could not reload '%s'; keeping the current pipeline: %v", path, err)
+		return
+	}
+	p.inherit(live.current())
+	live.replace(p)
+	log.Printf("Reloaded '%s'.", path)
+	logPipeline(p)
+}
+
+// Reloads the config file on SIGHUP or when the file changes, until
+// `stop` is closed. SIGHUP is caught as soon as this returns.
+func (live *livePipeline) watch(path string, interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				log.Printf("Received SIGHUP.")
+				live.reload(path)
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err == nil && !info.ModTime().Equal(lastModified) {
+					lastModified = info.ModTime()
+					log.Printf("'%s' changed.", path)
+					live.reload(path)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
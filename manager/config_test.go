@@ -0,0 +1,183 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path, url string) {
+	config := fmt.Sprintf(`{"name": "test", "stages": [{"name": "a", "url": "%s"}]}`, url)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForURL(t *testing.T, live *livePipeline, url string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for live.current().order[0].URL != url {
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline was not reloaded with '%s'", url)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestConfig(t *testing.T, url string) (string, *livePipeline) {
+	dir, err := ioutil.TempDir("", "plumber-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "pipeline.json")
+	writeTestConfig(t, path, url)
+	p, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, newLivePipeline(p)
+}
+
+func TestReloadOnChange(t *testing.T) {
+	path, live := newTestConfig(t, "http://first:9800")
+	defer os.RemoveAll(filepath.Dir(path))
+	stop := make(chan struct{})
+	defer close(stop)
+	live.watch(path, 10*time.Millisecond, stop)
+
+	// make sure the modification time changes
+	time.Sleep(20 * time.Millisecond)
+	writeTestConfig(t, path, "http://second:9800")
+	waitForURL(t, live, "http://second:9800")
+
+	// a broken config leaves the running pipeline alone
+	time.Sleep(20 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte(`{"stages": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if live.current().order[0].URL != "http://second:9800" {
+		t.Errorf("invalid config replaced the pipeline")
+	}
+}
+
+func TestReloadOnSighup(t *testing.T) {
+	path, live := newTestConfig(t, "http://first:9800")
+	defer os.RemoveAll(filepath.Dir(path))
+	stop := make(chan struct{})
+	defer close(stop)
+	live.watch(path, time.Hour, stop)
+
+	writeTestConfig(t, path, "http://second:9800")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitForURL(t, live, "http://second:9800")
+}
+
+func TestReloadKeepsInFlightRequests(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(makeEnhancer("slow", 100*time.Millisecond)))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(makeEnhancer("fast", 0)))
+	defer fast.Close()
+
+	live := newLivePipeline(newTestPipeline(t, withURLs(slow.URL)))
+	handler := createHandler(live)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		done <- w
+	}()
+	time.Sleep(20 * time.Millisecond)
+	live.replace(newTestPipeline(t, withURLs(fast.URL)))
+
+	w := <-done
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"slow"`) {
+		t.Errorf("in flight request was not finished by the old pipeline: %d %s", w.Code, w.Body.String())
+	}
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if !strings.Contains(w.Body.String(), `"fast"`) {
+		t.Errorf("new request did not use the new pipeline: %s", w.Body.String())
+	}
+}
+
+func TestReloadKeepsStageState(t *testing.T) {
+	config := `{"name": "test", "admission": {"maxInFlight": 4}, "stages": [
+		{"name": "a", "url": "http://a:9800", "admission": {"maxInFlight": 1}, "cache": {"ttl": "1m"},
+		 "policy": {"breaker": {"failures": 2}}},
+		{"name": "b", "url": "%s", "admission": {"maxInFlight": 1}, "policy": {"breaker": {"failures": 2}}}]}`
+	dir, err := ioutil.TempDir("", "plumber-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pipeline.json")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(config, "http://b:9800")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := newLivePipeline(old)
+
+	// a record is in flight at "b" when its url changes
+	if err := old.stage("b").limiter.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(config, "http://b2:9800")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	live.reload(path)
+	p := live.current()
+	if p == old {
+		t.Fatal("pipeline was not reloaded")
+	}
+
+	a, oldA := p.stage("a"), old.stage("a")
+	if a.breaker != oldA.breaker || a.cache != oldA.cache || a.balancer != oldA.balancer || a.limiter != oldA.limiter {
+		t.Errorf("unchanged stage lost its state on reload")
+	}
+	if p.limiter != old.limiter {
+		t.Errorf("pipeline admission limiter was not kept on reload")
+	}
+	b, oldB := p.stage("b"), old.stage("b")
+	if b.breaker == oldB.breaker || b.balancer == oldB.balancer {
+		t.Errorf("changed stage kept its old state")
+	}
+	if b.limiter != oldB.limiter {
+		t.Fatalf("changed stage did not keep its admission limiter")
+	}
+	// the record in flight on the old pipeline still counts
+	b.limiter.policy.queueTimeout = time.Millisecond
+	if err := b.limiter.acquire(); err == nil {
+		t.Errorf("new pipeline admitted a record over the limit")
+	}
+}
@@ -0,0 +1,99 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Dead letters are appended to this file in the pipeline's
+// `deadLetterDir`, one JSON object per line. `plumber dlq` reads the
+// same file.
+const deadLetterFile = "dead-letters.jsonl"
+
+// Responses to records that were stored as dead letters carry the id
+// of the letter in this header, so `plumber dlq replay` knows it can
+// drop the letter it replayed.
+const deadLetterHeader = "X-Plumber-Dead-Letter"
+
+// A record that failed in the pipeline.
+type deadLetter struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Pipeline string          `json:"pipeline,omitempty"`
+	Bundle   string          `json:"bundle,omitempty"` // the stage that failed
+	Status   int             `json:"status"`           // the status we gave the caller
+	Error    string          `json:"error"`
+	Record   json.RawMessage `json:"record"`            // the record sent to the pipeline
+	Partial  json.RawMessage `json:"partial,omitempty"` // the record the failing stage was sent
+}
+
+type deadLetterStore struct {
+	sync.Mutex
+	path string
+	seq  uint64
+}
+
+func newDeadLetterStore(dir string) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &deadLetterStore{path: filepath.Join(dir, deadLetterFile)}, nil
+}
+
+// Appends the record and the error it caused to the store. We open the
+// file for every write so that `plumber dlq replay` can move it out
+// from under us. Returns the id of the new letter.
+func (d *deadLetterStore) add(pipeline string, record []byte, err error) (string, error) {
+	if !json.Valid(record) {
+		return "", fmt.Errorf("Not storing dead letter; record is not valid JSON.")
+	}
+	status, details := describeError(err)
+
+	d.Lock()
+	defer d.Unlock()
+	d.seq++
+	now := time.Now().UTC()
+	letter := deadLetter{
+		ID:       fmt.Sprintf("%x-%d", now.UnixNano(), d.seq),
+		Time:     now,
+		Pipeline: pipeline,
+		Bundle:   details.Bundle,
+		Status:   status,
+		Error:    details.Message,
+		Record:   record,
+		Partial:  details.Record,
+	}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return "", err
+	}
+	return letter.ID, file.Close()
+}
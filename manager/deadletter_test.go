@@ -0,0 +1,152 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ok := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	}))
+	defer broken.Close()
+
+	dir := filepath.Join(tempDir, "dlq")
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "foo", "deadLetterDir": "%s", "stages": [
+		{"name": "a", "url": "%s"},
+		{"name": "b", "url": "%s", "depends": ["a"]}]}`, dir, ok.URL, broken.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := post(createHandler(p), "/", `{"foo": 3}`)
+	post(createHandler(p), "/", `{"foo": 3}`)
+
+	// replayed traffic isn't stored
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"foo": 3}`))
+	req.Header.Set(replayHeader, "1")
+	replayed := httptest.NewRecorder()
+	createHandler(p)(replayed, req)
+	if id := replayed.Header().Get(deadLetterHeader); id != "" {
+		t.Errorf("DeadLetters: replayed record was stored as '%s'", id)
+	}
+
+	file, err := os.Open(filepath.Join(dir, deadLetterFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	letters := []deadLetter{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+
+	if len(letters) != 2 || letters[0].ID == letters[1].ID {
+		t.Fatalf("DeadLetters: got '%v'", letters)
+	}
+	letter := letters[0]
+	if letter.Pipeline != "foo" || letter.Bundle != "b" || letter.Status != http.StatusBadGateway ||
+		letter.Error != "oops" || string(letter.Record) != `{"foo":3}` ||
+		string(letter.Partial) != `{"a":"a saw 1 fields","foo":3}` || letter.Time.IsZero() {
+		t.Errorf("DeadLetters: got '%v'", letter)
+	}
+	if id := first.Header().Get(deadLetterHeader); id != letter.ID {
+		t.Errorf("DeadLetters: response named dead letter '%s', expected '%s'", id, letter.ID)
+	}
+}
+
+func TestDeadLettersWithoutBundle(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ok := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ok.Close()
+
+	// the stage is fine, but the pipeline's response is too large
+	dir := filepath.Join(tempDir, "dlq")
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "foo", "deadLetterDir": "%s", "limits": {"response": 5}, "stages": [
+		{"name": "a", "url": "%s"}]}`, dir, ok.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := post(createHandler(p), "/", `{"foo": 3}`)
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get(deadLetterHeader) == "" {
+		t.Errorf("DeadLetters: expected a 413 naming its dead letter, got %d '%s'", w.Code, w.Header().Get(deadLetterHeader))
+	}
+}
+
+func TestDeadLettersReplayNeedsAdmin(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	}))
+	defer broken.Close()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "foo", "deadLetterDir": "%s",
+		"auth": {"apiKeys": ["key"]}, "admin": {"tokens": ["admin"]},
+		"stages": [{"name": "b", "url": "%s"}]}`, filepath.Join(tempDir, "dlq"), broken.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requireAuth(p, createHandler(p))
+	for header, stored := range map[[2]string]bool{
+		{apiKeyHeader, "key"}:             true,
+		{"Authorization", "Bearer admin"}: false,
+	} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"foo": 3}`))
+		req.Header.Set(header[0], header[1])
+		req.Header.Set(replayHeader, "1")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%v got status %d, expected a 502", header, w.Code)
+		}
+		if id := w.Header().Get(deadLetterHeader); (id != "") != stored {
+			t.Errorf("%v was stored as dead letter '%s', expected that to be %v", header, id, stored)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// A non-2xx response from an enhancer.
+type enhancerError struct {
+	status  int
+	message string
+}
+
+func (e *enhancerError) Error() string {
+	return fmt.Sprintf("enhancer responded with %d: %s", e.status, e.message)
+}
+
+// Whether it's worth sending the record again after getting `err`.
+// Enhancers reject records they can't handle with a 4xx; sending them
+// again won't help.
+func retryable(err error) bool {
+	if enhancerErr, ok := err.(*enhancerError); ok {
+		return enhancerErr.status >= 500
+	}
+	if _, ok := err.(*sizeError); ok {
+		return false
+	}
+	if _, ok := err.(*overloadError); ok {
+		return false
+	}
+	return err != nil
+}
+
+// An error from a stage, along with the HTTP status we should give the
+// caller and the record the stage was sent.
+type stageError struct {
+	stage  string
+	status int
+	err    error
+	record []byte
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("Stage '%s' failed: %v", e.stage, e.err)
+}
+
+func newStageError(s *stage, err error, record []byte) *stageError {
+	status := http.StatusBadGateway
+	if overloadErr, ok := err.(*overloadError); ok {
+		status = overloadErr.status
+	} else if _, ok := err.(*sizeError); ok {
+		status = http.StatusRequestEntityTooLarge
+	} else if enhancerErr, ok := err.(*enhancerError); ok && enhancerErr.status < 500 {
+		status = http.StatusUnprocessableEntity
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+	return &stageError{s.Name, status, err, record}
+}
+
+// An error in the request sent to the manager.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// The body of an error response from the manager. Results in a batch
+// or stream can't have headers of their own, so they list the bundles
+// the record skipped here.
+type errorResponse struct {
+	Error   errorDetails `json:"error"`
+	Skipped []string     `json:"skipped,omitempty"`
+}
+
+type errorDetails struct {
+	Bundle  string          `json:"bundle,omitempty"` // the stage that failed
+	Status  int             `json:"status,omitempty"` // the enhancer's status code
+	Message string          `json:"message"`
+	Record  json.RawMessage `json:"record,omitempty"` // what the stage was sent
+}
+
+// Describes `err` and picks the HTTP status to send with it.
+func describeError(err error) (int, errorDetails) {
+	status := http.StatusInternalServerError
+	details := errorDetails{Message: err.Error()}
+
+	switch e := err.(type) {
+	case *requestError:
+		status = e.status
+	case *overloadError:
+		status = e.status
+	case *stageError:
+		status = e.status
+		details.Bundle = e.stage
+		details.Message = e.err.Error()
+		if enhancerErr, ok := e.err.(*enhancerError); ok {
+			details.Status = enhancerErr.status
+			details.Message = enhancerErr.message
+		}
+		if json.Valid(e.record) {
+			details.Record = e.record
+		}
+	}
+	return status, details
+}
+
+// Builds the JSON error response for `err` and the HTTP status to
+// send with it.
+func errorJSON(err error, skipped []string) (int, []byte) {
+	status, details := describeError(err)
+	body, err := json.Marshal(errorResponse{details, skipped})
+	if err != nil {
+		// this only happens if the record isn't valid JSON, which we
+		// checked for above
+		panic(err)
+	}
+	return status, body
+}
+
+// Bundles' errors are logged along with the record they failed, so
+// only errors from before the record reached the pipeline are logged
+// here.
+func logRequestError(err error) {
+	if _, ok := err.(*stageError); !ok {
+		log.Printf("%v", err)
+	}
+}
+
+// Writes `err` to the caller as a JSON error response.
+func writeError(w http.ResponseWriter, err error) {
+	logRequestError(err)
+	status, body := errorJSON(err, nil)
+	overloadErr, ok := err.(*overloadError)
+	if stageErr, isStageErr := err.(*stageError); isStageErr {
+		overloadErr, ok = stageErr.err.(*overloadError)
+	}
+	if ok {
+		w.Header().Set("Retry-After", overloadErr.retryAfterSeconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
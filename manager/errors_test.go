@@ -0,0 +1,98 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) errorDetails {
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Could not decode error response '%s': %v", w.Body.String(), err)
+	}
+	return resp.Error
+}
+
+// Test that an enhancer rejecting a record gives the caller the
+// failing bundle, its message and the record it was sent.
+func TestErrorFromEnhancer(t *testing.T) {
+	ts1 := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ts1.Close()
+	var calls int32
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "Missing required 'b' field in JSON data.", 400)
+	}))
+	defer ts2.Close()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"stages": [
+		{"name": "a", "url": "%s"},
+		{"name": "b", "url": "%s", "depends": ["a"], "policy": {"idempotent": true, "retries": 3}}]}`, ts1.URL, ts2.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := post(createHandler(p), "/", `{"foo": 3}`)
+	if w.Code != http.StatusUnprocessableEntity || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("ErrorFromEnhancer: got %d '%s'", w.Code, w.Header().Get("Content-Type"))
+	}
+	details := decodeError(t, w)
+	if details.Bundle != "b" || details.Status != 400 ||
+		details.Message != "Missing required 'b' field in JSON data." ||
+		string(details.Record) != `{"a":"a saw 1 fields","foo":3}` {
+		t.Errorf("ErrorFromEnhancer: got '%v'", details)
+	}
+	// the record was rejected, so retrying it won't help
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("ErrorFromEnhancer: enhancer was called %d times", n)
+	}
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	down.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	}))
+	defer broken.Close()
+	slow := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 100*time.Millisecond)))
+	defer slow.Close()
+
+	cases := []struct {
+		url    string
+		policy string
+		code   int
+	}{
+		{down.URL, `{}`, http.StatusBadGateway},
+		{broken.URL, `{}`, http.StatusBadGateway},
+		{slow.URL, `{"timeout": "10ms"}`, http.StatusGatewayTimeout},
+	}
+	for _, c := range cases {
+		p := newTestPipeline(t, withStages(`{"name": "a", "url": %q, "policy": %s}`, c.url, c.policy))
+		w := post(createHandler(p), "/", `{"foo": 3}`)
+		details := decodeError(t, w)
+		if w.Code != c.code || details.Bundle != "a" || details.Message == "" {
+			t.Errorf("ErrorStatusCodes: expected %d from '%s', got %d '%v'", c.code, c.url, w.Code, details)
+		}
+	}
+}
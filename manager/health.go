@@ -0,0 +1,134 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long we wait for an enhancer's /info before calling it
+// unreachable.
+const probeTimeout = 2 * time.Second
+
+type stageStatus struct {
+	Bundle string `json:"bundle"`
+	URL    string `json:"url"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Ready       bool          `json:"ready"`
+	Draining    bool          `json:"draining,omitempty"`
+	Unreachable []string      `json:"unreachable"`
+	Stages      []stageStatus `json:"stages"`
+}
+
+// Every enhancer built by `plumber bundle` serves its inputs and
+// outputs at /info; if that responds, the enhancer is up.
+func probe(client *http.Client, bundle, url string) stageStatus {
+	status := stageStatus{Bundle: bundle, URL: url}
+	resp, err := client.Get(strings.TrimRight(url, "/") + "/info")
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		status.Error = fmt.Sprintf("/info responded with %d", resp.StatusCode)
+		return status
+	}
+	status.OK = true
+	return status
+}
+
+// Probes every endpoint of every stage concurrently. A stage is
+// unreachable if none of its endpoints respond.
+func (p *pipeline) health() healthReport {
+	report := healthReport{
+		Ready:       true,
+		Unreachable: []string{},
+		Stages:      []stageStatus{},
+	}
+	for _, s := range p.order {
+		for _, u := range s.balancer.urls() {
+			report.Stages = append(report.Stages, stageStatus{Bundle: s.Name, URL: u})
+		}
+	}
+	done := make(chan struct{})
+	for i := range report.Stages {
+		go func(i int) {
+			report.Stages[i] = probe(p.probeClient, report.Stages[i].Bundle, report.Stages[i].URL)
+			done <- struct{}{}
+		}(i)
+	}
+	for range report.Stages {
+		<-done
+	}
+
+	reachable := make(map[string]bool)
+	for _, status := range report.Stages {
+		reachable[status.Bundle] = reachable[status.Bundle] || status.OK
+	}
+	for _, s := range p.order {
+		if !reachable[s.Name] {
+			report.Ready = false
+			report.Unreachable = append(report.Unreachable, s.Name)
+		}
+	}
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport, status int) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// The manager is healthy as long as it can respond; the report tells
+// you which enhancers it can't reach.
+func createHealthzHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, source.current().health(), http.StatusOK)
+	}
+}
+
+// The manager is only ready once every enhancer responds, and stops
+// being ready as soon as it starts shutting down.
+func createReadyzHandler(source pipelineSource, drain *drainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if drain.isDraining() {
+			// we're shutting down, so there's no point probing anyone
+			writeHealth(w, healthReport{Draining: true, Unreachable: []string{}, Stages: []stageStatus{}}, http.StatusServiceUnavailable)
+			return
+		}
+		report := source.current().health()
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, report, status)
+	}
+}
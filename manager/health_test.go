@@ -0,0 +1,76 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// an enhancer that serves /info like the python wrapper does
+func newInfoServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"bundle": "up", "inputs": {}, "outputs": {}}`))
+	})
+	mux.HandleFunc("/", makeEnhancer("up", 0))
+	return httptest.NewServer(mux)
+}
+
+func getHealth(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (int, healthReport) {
+	req, _ := http.NewRequest("GET", "http://foobar.com", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var report healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+func TestHealth(t *testing.T) {
+	up := newInfoServer()
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"stages": [
+		{"name": "up", "url": "%s"},
+		{"name": "down", "url": "%s", "depends": ["up"]}]}`, up.URL, down.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, report := getHealth(t, createHealthzHandler(p))
+	if code != 200 || report.Ready || fmt.Sprint(report.Unreachable) != "[down]" ||
+		!report.Stages[0].OK || report.Stages[1].OK || report.Stages[1].Error == "" {
+		t.Errorf("Health: /healthz got %d '%v'", code, report)
+	}
+
+	code, report = getHealth(t, createReadyzHandler(p, nil))
+	if code != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("Health: /readyz got %d '%v'", code, report)
+	}
+
+	code, report = getHealth(t, createReadyzHandler(newTestPipeline(t, withURLs(up.URL)), nil))
+	if code != 200 || !report.Ready || len(report.Unreachable) != 0 {
+		t.Errorf("Health: /readyz got %d '%v'", code, report)
+	}
+}
@@ -0,0 +1,271 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states a job goes through.
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// How many times we try to deliver a job to its callback, and how long
+// we wait between tries (doubling each time).
+const (
+	callbackAttempts = 3
+	callbackBackoff  = time.Second
+	callbackTimeout  = 10 * time.Second
+)
+
+// A record sent through the pipeline in the background.
+type job struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Created  time.Time       `json:"created"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *errorDetails   `json:"error,omitempty"`
+	Skipped  []string        `json:"skipped,omitempty"` // bundles the record skipped
+
+	callback string
+}
+
+// Keeps jobs until they expire. Once it holds `max` jobs, the oldest
+// finished job makes room for a new one; if every job is still
+// pending, new jobs are turned away.
+type jobStore struct {
+	sync.Mutex
+	max      int
+	ttl      time.Duration
+	jobs     map[string]*job
+	order    []string // job ids, oldest first
+	callback *http.Client
+	backoff  time.Duration
+	hosts    map[string]bool // the hosts callbacks may go to
+}
+
+// Callbacks may only go to `callbackHosts`, so that callers can't have
+// the manager post records to internal services. Without any, there
+// are no callbacks.
+func newJobStore(max int, ttl time.Duration, callbackHosts []string) *jobStore {
+	hosts := make(map[string]bool)
+	for _, host := range callbackHosts {
+		hosts[strings.ToLower(host)] = true
+	}
+	return &jobStore{
+		max:  max,
+		ttl:  ttl,
+		jobs: make(map[string]*job),
+		callback: &http.Client{
+			Timeout: callbackTimeout,
+			// a redirect could take us to a host that isn't allowed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		backoff: callbackBackoff,
+		hosts:   hosts,
+	}
+}
+
+// Checks that `callback` is a url we may post jobs to. A host can be
+// allowed with or without its port.
+func (s *jobStore) checkCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &requestError{http.StatusBadRequest, fmt.Sprintf("'%s' is not a valid callback url.", callback)}
+	}
+	if !s.hosts[strings.ToLower(u.Host)] && !s.hosts[strings.ToLower(u.Hostname())] {
+		return &requestError{http.StatusBadRequest, fmt.Sprintf("Callbacks to '%s' are not allowed.", u.Host)}
+	}
+	return nil
+}
+
+// Drops expired jobs and, if the store is still full, the oldest
+// finished one. Must be called with the lock held.
+func (s *jobStore) evict(now time.Time) {
+	kept := s.order[:0]
+	for _, id := range s.order {
+		j := s.jobs[id]
+		if j.Finished != nil && now.Sub(*j.Finished) > s.ttl {
+			delete(s.jobs, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+	if len(s.order) < s.max {
+		return
+	}
+	for i, id := range s.order {
+		if s.jobs[id].Finished != nil {
+			delete(s.jobs, id)
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *jobStore) add(callback string) (*job, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.evict(now)
+	if len(s.order) >= s.max {
+		return nil, &requestError{http.StatusTooManyRequests, fmt.Sprintf("There are already %d jobs running.", len(s.order))}
+	}
+	j := &job{ID: newRequestID(), Status: jobPending, Created: now, callback: callback}
+	s.jobs[j.ID] = j
+	s.order = append(s.order, j.ID)
+	return j, nil
+}
+
+// A copy of the job, so it can be written out without holding the lock.
+func (s *jobStore) get(id string) (job, bool) {
+	s.Lock()
+	defer s.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (s *jobStore) finish(j *job, result []byte, err error, skipped []string) job {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.Skipped = skipped
+	if err != nil {
+		_, details := describeError(err)
+		j.Status, j.Error = jobFailed, &details
+	} else {
+		j.Status, j.Result = jobDone, rawRecord(result)
+	}
+	return *j
+}
+
+// Sends the record through the pipeline and keeps the result.
+func (s *jobStore) run(p *pipeline, j *job, record []byte) {
+	var output []byte
+	t := newTrace(j.ID)
+	err := p.limiter.acquire()
+	if err == nil {
+		output, err = p.run(record, t)
+		p.limiter.release()
+	}
+	finished := s.finish(j, output, err, t.skippedBundles())
+	if j.callback != "" {
+		s.deliver(finished)
+	}
+}
+
+// Posts the finished job to its callback, trying again if that fails.
+func (s *jobStore) deliver(j job) {
+	body, err := json.Marshal(j)
+	if err != nil {
+		logEvent(logFields{RequestID: j.ID, Err: err}, "Could not encode job '%s': %v", j.ID, err)
+		return
+	}
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := s.callback.Post(j.callback, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("callback responded with %d", resp.StatusCode)
+		}
+		if attempt == callbackAttempts {
+			logEvent(logFields{RequestID: j.ID, Err: err}, "Could not deliver job '%s' to '%s': %v", j.ID, j.callback, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func writeJob(w http.ResponseWriter, j job, status int) {
+	body, err := json.Marshal(j)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// `POST /jobs` accepts a record and runs it in the background,
+// responding straight away with the job's id. `GET /jobs/ID` gives the
+// job's status and, once it's finished, its result or error. With a
+// `callback` url, the finished job is also posted there. Jobs are
+// tracked by the drainer, so the manager finishes them, callbacks and
+// all, before it shuts down.
+func createJobsHandler(source pipelineSource, store *jobStore, drain *drainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+		switch {
+		case r.Method == "GET" && id != "":
+			j, ok := store.get(id)
+			if !ok {
+				writeError(w, &requestError{http.StatusNotFound, fmt.Sprintf("There is no job '%s'.", id)})
+				return
+			}
+			writeJob(w, j, http.StatusOK)
+		case r.Method == "POST" && id == "":
+			callback := r.URL.Query().Get("callback")
+			if callback != "" {
+				if err := store.checkCallback(callback); err != nil {
+					writeError(w, err)
+					return
+				}
+			}
+			p := source.current()
+			record, err := readLimited(r.Body, p.Limits.Request, "the record")
+			if sizeErr, ok := err.(*sizeError); ok {
+				writeError(w, tooLarge(sizeErr.what, sizeErr.limit))
+				return
+			} else if err != nil {
+				writeError(w, &requestError{http.StatusBadRequest, err.Error()})
+				return
+			}
+			j, err := store.add(callback)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			drain.background(func() { store.run(p, j, record) })
+			w.Header().Set("Location", "/jobs/"+j.ID)
+			writeJob(w, job{ID: j.ID, Status: jobPending, Created: j.Created}, http.StatusAccepted)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func postJob(t *testing.T, handler func(w http.ResponseWriter, r *http.Request), query, record string) (int, job) {
+	w := post(handler, "/jobs"+query, record)
+	var j job
+	if w.Code == http.StatusAccepted {
+		if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+			t.Fatal(err)
+		}
+		if w.Header().Get("Location") != "/jobs/"+j.ID {
+			t.Errorf("job '%s' has location '%s'", j.ID, w.Header().Get("Location"))
+		}
+	}
+	return w.Code, j
+}
+
+func getJob(t *testing.T, handler func(w http.ResponseWriter, r *http.Request), id string) (int, job) {
+	req, _ := http.NewRequest("GET", "/jobs/"+id, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	var j job
+	json.Unmarshal(w.Body.Bytes(), &j)
+	return w.Code, j
+}
+
+// Polls the job until it finishes.
+func waitForJob(t *testing.T, handler func(w http.ResponseWriter, r *http.Request), id string) job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if code, j := getJob(t, handler, id); code != http.StatusOK {
+			t.Fatalf("job '%s' got status %d", id, code)
+		} else if j.Status != jobPending {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job '%s' never finished", id)
+	return job{}
+}
+
+func TestJobs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 50*time.Millisecond)))
+	defer ts.Close()
+	handler := createJobsHandler(newTestPipeline(t, withURLs(ts.URL)), newJobStore(10, time.Hour, nil), nil)
+
+	code, j := postJob(t, handler, "", `{"x": 1}`)
+	if code != http.StatusAccepted || j.ID == "" || j.Status != jobPending {
+		t.Fatalf("got status %d and job %+v", code, j)
+	}
+	j = waitForJob(t, handler, j.ID)
+	if j.Status != jobDone || j.Finished == nil || j.Error != nil {
+		t.Fatalf("unexpected job %+v", j)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(j.Result, &result); err != nil || result["a"] != "a saw 1 fields" {
+		t.Errorf("unexpected result '%s'", j.Result)
+	}
+
+	if code, _ := getJob(t, handler, "nope"); code != http.StatusNotFound {
+		t.Errorf("an unknown job got status %d", code)
+	}
+	if code, _ := postJob(t, handler, "?callback=ftp://nope", `{}`); code != http.StatusBadRequest {
+		t.Errorf("a bad callback got status %d", code)
+	}
+}
+
+func TestJobFailed(t *testing.T) {
+	ts := makeFixedEnhancer("not json")
+	defer ts.Close()
+	p := newTestPipeline(t, withSettings(`"merge": {}`), withStages(`{"name": "a", "url": %q}`, ts.URL))
+	handler := createJobsHandler(p, newJobStore(10, time.Hour, nil), nil)
+
+	_, j := postJob(t, handler, "", `{"x": 1}`)
+	j = waitForJob(t, handler, j.ID)
+	if j.Status != jobFailed || j.Error == nil || j.Error.Bundle != "a" || j.Result != nil {
+		t.Errorf("unexpected job %+v", j)
+	}
+}
+
+func TestJobCallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ts.Close()
+	delivered := make(chan job, 1)
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first time, so the manager has to try again
+		if attempts++; attempts == 1 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		var j job
+		json.NewDecoder(r.Body).Decode(&j)
+		delivered <- j
+	}))
+	defer callback.Close()
+	u, _ := url.Parse(callback.URL)
+	store := newJobStore(10, time.Hour, []string{u.Host})
+	store.backoff = time.Millisecond
+	handler := createJobsHandler(newTestPipeline(t, withURLs(ts.URL)), store, nil)
+
+	_, posted := postJob(t, handler, "?callback="+callback.URL, `{"x": 1}`)
+	select {
+	case j := <-delivered:
+		if j.ID != posted.ID || j.Status != jobDone || j.Result == nil {
+			t.Errorf("unexpected callback %+v", j)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was never called")
+	}
+}
+
+// Test that a full store turns jobs away while they're all running, and
+// makes room by dropping the oldest finished job.
+func TestJobStoreBounded(t *testing.T) {
+	release := make(chan struct{})
+	enhancer := makeEnhancer("a", 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		enhancer(w, r)
+	}))
+	defer ts.Close()
+	handler := createJobsHandler(newTestPipeline(t, withURLs(ts.URL)), newJobStore(1, time.Hour, nil), nil)
+
+	_, first := postJob(t, handler, "", `{"x": 1}`)
+	if code, _ := postJob(t, handler, "", `{"x": 2}`); code != http.StatusTooManyRequests {
+		t.Errorf("a full store got status %d", code)
+	}
+	close(release)
+	waitForJob(t, handler, first.ID)
+
+	code, second := postJob(t, handler, "", `{"x": 3}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d once the first job finished", code)
+	}
+	if code, _ := getJob(t, handler, first.ID); code != http.StatusNotFound {
+		t.Errorf("the first job is still there: %d", code)
+	}
+	waitForJob(t, handler, second.ID)
+}
+
+func TestJobStoreExpires(t *testing.T) {
+	store := newJobStore(10, time.Millisecond, nil)
+	j, _ := store.add("")
+	store.finish(j, []byte(`{}`), nil, nil)
+	time.Sleep(5 * time.Millisecond)
+	store.add("")
+	if _, ok := store.get(j.ID); ok {
+		t.Error("the finished job did not expire")
+	}
+}
+
+func TestJobCallbackHosts(t *testing.T) {
+	store := newJobStore(10, time.Hour, []string{"hooks.example.com", "10.0.0.5:8080"})
+	handler := createJobsHandler(newTestPipeline(t, withURLs("http://a:9800")), store, nil)
+	for callback, allowed := range map[string]bool{
+		"https://hooks.example.com/done":     true,
+		"http://HOOKS.example.com:9000/done": true,
+		"http://10.0.0.5:8080/done":          true,
+		"http://10.0.0.5:9090/done":          false,
+		"http://169.254.169.254/latest":      false,
+		"http://localhost:9800/jobs":         false,
+	} {
+		code, _ := postJob(t, handler, "?callback="+url.QueryEscape(callback), `{}`)
+		if allowed && code != http.StatusAccepted || !allowed && code != http.StatusBadRequest {
+			t.Errorf("a callback to '%s' got status %d", callback, code)
+		}
+	}
+
+	// without any hosts, there are no callbacks
+	handler = createJobsHandler(newTestPipeline(t, withURLs("http://a:9800")), newJobStore(10, time.Hour, nil), nil)
+	if code, _ := postJob(t, handler, "?callback=http://hooks.example.com", `{}`); code != http.StatusBadRequest {
+		t.Errorf("a callback got status %d without any callback hosts", code)
+	}
+}
@@ -0,0 +1,101 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// The default size limit for records, in bytes.
+const defaultMaxRecordSize = 1048576
+
+// Size limits, in bytes. The pipeline's limits apply to the records we
+// accept and the responses we give; a stage's limits apply to the
+// records we send it and the responses we accept from it, and default
+// to the pipeline's.
+type limits struct {
+	Request  int64 `json:"request,omitempty"`
+	Response int64 `json:"response,omitempty"`
+}
+
+// Fills in any limits that aren't set from `defaults`.
+func (l *limits) init(defaults limits) error {
+	if l.Request < 0 || l.Response < 0 {
+		return fmt.Errorf("Limits cannot be negative.")
+	}
+	if l.Request == 0 {
+		l.Request = defaults.Request
+	}
+	if l.Response == 0 {
+		l.Response = defaults.Response
+	}
+	return nil
+}
+
+// A record or response that is over its limit.
+type sizeError struct {
+	what  string
+	limit int64
+}
+
+func (e *sizeError) Error() string {
+	return fmt.Sprintf("%s is larger than the limit of %d bytes", e.what, e.limit)
+}
+
+// Reads from `r` until it's exhausted or more than `limit` bytes have
+// been read, in which case `err` is set and returned.
+type limitedReader struct {
+	r     io.Reader
+	what  string
+	limit int64
+	read  int64
+	err   *sizeError
+}
+
+func newLimitedReader(r io.Reader, limit int64, what string) *limitedReader {
+	return &limitedReader{r: r, what: what, limit: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	// read at most one byte more than we allow, so we know when a
+	// reader is over its limit without reading the rest of it
+	if remaining := l.limit + 1 - l.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.err = &sizeError{l.what, l.limit}
+		return n - int(l.read-l.limit), l.err
+	}
+	return n, err
+}
+
+// The error we respond with when a record or response is over its
+// limit.
+func tooLarge(what string, limit int64) *requestError {
+	return &requestError{http.StatusRequestEntityTooLarge, (&sizeError{what, limit}).Error()}
+}
+
+func readLimited(r io.Reader, limit int64, what string) ([]byte, error) {
+	return ioutil.ReadAll(newLimitedReader(r, limit, what))
+}
@@ -0,0 +1,117 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitedReader(t *testing.T) {
+	data, err := readLimited(strings.NewReader("12345"), 5, "five")
+	if err != nil || string(data) != "12345" {
+		t.Errorf("expected '12345', got '%s' and %v", data, err)
+	}
+	data, err = readLimited(strings.NewReader("123456"), 5, "six")
+	if _, ok := err.(*sizeError); !ok || string(data) != "12345" {
+		t.Errorf("expected a size error, got '%s' and %v", data, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	big := makeFixedEnhancer(fmt.Sprintf(`{"x": "%s"}`, strings.Repeat("x", 100)))
+	defer big.Close()
+	echo := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer echo.Close()
+
+	// the record we were sent
+	p := newTestPipeline(t, withSettings(`"limits": {"request": 10}`), withURLs(echo.URL))
+	w := post(createHandler(p), "/", `{"a": "0123456789"}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413 for a large request, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// the record we send a stage
+	p = newTestPipeline(t, withStageSettings(`"limits": {"request": 10}`), withURLs(echo.URL))
+	w = post(createHandler(p), "/", `{"a": "0123456789"}`)
+	if details := decodeError(t, w); w.Code != http.StatusRequestEntityTooLarge || details.Bundle != echo.URL {
+		t.Errorf("expected a 413 from the stage, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// the response from a stage is no longer truncated
+	p = newTestPipeline(t, withStageSettings(`"limits": {"response": 50}`), withURLs(big.URL))
+	w = post(createHandler(p), "/", `{}`)
+	if details := decodeError(t, w); w.Code != http.StatusRequestEntityTooLarge || details.Bundle != big.URL {
+		t.Errorf("expected a 413 from the stage, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// the response we give
+	p = newTestPipeline(t, withSettings(`"limits": {"response": 50}`), withStageSettings(`"limits": {"response": 1000}`), withURLs(big.URL))
+	w = post(createHandler(p), "/", `{}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413 for a large response, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// a record in a stream
+	p = newTestPipeline(t, withSettings(`"limits": {"request": 10}`), withURLs(echo.URL))
+	w = post(createStreamHandler(p), "/stream", "{}\n{\"a\": \"0123456789\"}\n")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "larger than the limit") {
+		t.Errorf("expected a 413 for the second record, got '%s'", w.Body.String())
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeEnhancer("b", 0)))
+	defer b.Close()
+	big := makeFixedEnhancer(fmt.Sprintf(`{"x": "%s"}`, strings.Repeat("x", 100)))
+	defer big.Close()
+
+	p := newTestPipeline(t, withURLs(a.URL, b.URL))
+	w := post(createPipeHandler(p), "/pipe", `{"x": 1}`)
+	expected := `{"a":"a saw 1 fields","b":"b saw 2 fields","x":1}`
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("expected '%s', got %d '%s'", expected, w.Code, w.Body.String())
+	}
+	if timing := w.Header().Get(serverTimingHeader); !strings.HasPrefix(timing, "stage0;") {
+		t.Errorf("unexpected Server-Timing header '%s'", timing)
+	}
+
+	p = newTestPipeline(t, withSettings(`"limits": {"request": 5}`), withURLs(a.URL, b.URL))
+	w = post(createPipeHandler(p), "/pipe", `{"x": 1}`)
+	if details := decodeError(t, w); w.Code != http.StatusRequestEntityTooLarge || details.Bundle != "" {
+		t.Errorf("expected a 413 for a large request, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// the first stage responds with too much; the second stage is
+	// still reading it when we notice
+	p = newTestPipeline(t, withStageSettings(`"limits": {"response": 50}`), withURLs(big.URL, a.URL))
+	w = post(createPipeHandler(p), "/pipe", `{}`)
+	if details := decodeError(t, w); w.Code != http.StatusRequestEntityTooLarge || details.Bundle != big.URL {
+		t.Errorf("expected a 413 from the stage, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// only chains can be streamed
+	p = newTestPipeline(t, withStages(`{"name": "a", "url": %q}, {"name": "b", "url": %q}`, a.URL, b.URL))
+	if w := post(createPipeHandler(p), "/pipe", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a pipeline that isn't a chain, got %d", w.Code)
+	}
+}
@@ -0,0 +1,126 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// With `lineage`, records the pipeline returns get this field, saying
+// where each of their fields came from and which stages they went
+// through.
+const lineageField = "_plumber"
+
+// Where a field came from: a bundle, or the record the caller sent.
+type fieldSource struct {
+	Bundle string `json:"bundle,omitempty"`
+	Image  string `json:"image,omitempty"` // the version of the bundle, if we know it
+	Input  bool   `json:"input,omitempty"`
+}
+
+var inputSource = &fieldSource{Input: true}
+
+type lineage map[string]*fieldSource
+
+type lineageStage struct {
+	Bundle   string  `json:"bundle"`
+	Duration float64 `json:"duration_ms"`
+}
+
+type lineageMetadata struct {
+	Fields  lineage        `json:"fields"`
+	Stages  []lineageStage `json:"stages"`
+	Skipped []string       `json:"skipped,omitempty"` // bundles the record skipped
+}
+
+// A record, and where its fields came from.
+type tracedRecord struct {
+	record  []byte
+	lineage lineage
+}
+
+// Works out where each field of `record` came from. A field with the
+// same value in one of the `sources` came from wherever it came from
+// there; the rest came from `producer`. Later sources win, as they do
+// when records are merged.
+func traceFields(record []byte, sources []tracedRecord, producer *fieldSource) lineage {
+	f, err := decodeFields(record)
+	if err != nil {
+		return lineage{}
+	}
+	decoded := make([]fields, len(sources))
+	for i, source := range sources {
+		decoded[i], _ = decodeFields(source.record)
+	}
+	l := make(lineage, len(f))
+	for name, value := range f {
+		if name == lineageField {
+			continue
+		}
+		from := producer
+		for i := len(sources) - 1; i >= 0; i-- {
+			if old, ok := decoded[i][name]; ok && bytes.Equal(old, value) && sources[i].lineage[name] != nil {
+				from = sources[i].lineage[name]
+				break
+			}
+		}
+		if from != nil {
+			l[name] = from
+		}
+	}
+	return l
+}
+
+// The outputs of the given stages, and where their fields came from.
+func tracedOutputs(indices []int, outputs [][]byte, lineages []lineage) []tracedRecord {
+	traced := make([]tracedRecord, len(indices))
+	for i, j := range indices {
+		traced[i] = tracedRecord{outputs[j], lineages[j]}
+	}
+	return traced
+}
+
+// The stages the record went through, in the order they finished. A
+// nil trace went through none.
+func (t *trace) stages() []lineageStage {
+	stages := []lineageStage{}
+	if t == nil {
+		return stages
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, timing := range t.timings {
+		stages = append(stages, lineageStage{timing.bundle, float64(timing.elapsed) / float64(time.Millisecond)})
+	}
+	return stages
+}
+
+// Adds the lineage to the pipeline's output. Only JSON objects can
+// have one; anything else is left alone.
+func addLineage(output []byte, l lineage, t *trace) ([]byte, error) {
+	f := make(map[string]json.RawMessage)
+	if json.Unmarshal(output, &f) != nil {
+		return output, nil
+	}
+	metadata, err := json.Marshal(lineageMetadata{l, t.stages(), t.skippedBundles()})
+	if err != nil {
+		return nil, err
+	}
+	f[lineageField] = metadata
+	return json.Marshal(f)
+}
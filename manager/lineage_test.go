@@ -0,0 +1,127 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type lineageResult struct {
+	Metadata *lineageMetadata `json:"_plumber"`
+}
+
+func runLineage(t *testing.T, config, record string) (map[string]fieldSource, []string) {
+	p, err := parsePipeline([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := p.run([]byte(record), newTrace("abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result lineageResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		t.Fatalf("'%s': %v", output, err)
+	}
+	if result.Metadata == nil {
+		return nil, nil
+	}
+	fields := make(map[string]fieldSource)
+	for name, source := range result.Metadata.Fields {
+		fields[name] = *source
+	}
+	stages := []string{}
+	for _, s := range result.Metadata.Stages {
+		if s.Duration <= 0 {
+			t.Errorf("stage '%s' took %vms", s.Bundle, s.Duration)
+		}
+		stages = append(stages, s.Bundle)
+	}
+	return fields, stages
+}
+
+func TestLineage(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeEnhancer("b", 0)))
+	defer b.Close()
+	c := httptest.NewServer(http.HandlerFunc(makeEnhancer("c", 0)))
+	defer c.Close()
+	config := fmt.Sprintf(`{"name": "foo", "lineage": true, "stages": [
+		{"name": "a", "url": "%s", "image": "sha256:aaa"},
+		{"name": "b", "url": "%s"},
+		{"name": "c", "url": "%s", "depends": ["a", "b"], "image": "sha256:ccc"}]}`, a.URL, b.URL, c.URL)
+
+	fields, stages := runLineage(t, config, `{"x": 1}`)
+	expected := map[string]fieldSource{
+		"x": {Input: true},
+		"a": {Bundle: "a", Image: "sha256:aaa"},
+		"b": {Bundle: "b"},
+		"c": {Bundle: "c", Image: "sha256:ccc"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("got lineage %+v", fields)
+	}
+	if len(stages) != 3 || stages[2] != "c" {
+		t.Errorf("got stages %v", stages)
+	}
+}
+
+// Test that a field a bundle changes is its, and that fields a bundle
+// drops are dropped from the lineage too.
+func TestLineageChangedFields(t *testing.T) {
+	a := makeFixedEnhancer(`{"x": 2, "y": "kept"}`)
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeEnhancer("b", 0)))
+	defer b.Close()
+	config := fmt.Sprintf(`{"name": "foo", "lineage": true, "stages": [
+		{"name": "a", "url": "%s"},
+		{"name": "b", "url": "%s", "depends": ["a"]}]}`, a.URL, b.URL)
+
+	fields, stages := runLineage(t, config, `{"x": 1, "y": "kept", "z": true, "_plumber": "theirs"}`)
+	expected := map[string]fieldSource{
+		"x": {Bundle: "a"},
+		"y": {Input: true},
+		"b": {Bundle: "b"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("got lineage %+v", fields)
+	}
+	if !reflect.DeepEqual(stages, []string{"a", "b"}) {
+		t.Errorf("got stages %v", stages)
+	}
+}
+
+func TestLineageOff(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer a.Close()
+	fields, _ := runLineage(t, fmt.Sprintf(`{"name": "foo", "stages": [{"name": "a", "url": "%s"}]}`, a.URL), `{"x": 1}`)
+	if fields != nil {
+		t.Errorf("got lineage %+v without asking for it", fields)
+	}
+}
+
+func TestAddLineageNotObject(t *testing.T) {
+	output, err := addLineage([]byte(`[1, 2]`), lineage{}, nil)
+	if err != nil || string(output) != `[1, 2]` {
+		t.Errorf("got '%s' and error %v", output, err)
+	}
+}
@@ -0,0 +1,157 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The manager logs text by default. With -log-format json (or
+// PLUMBER_LOG_FORMAT=json), every line is a JSON object with the same
+// fields the CLI and the bundle wrapper use.
+const (
+	logText      = "text"
+	logJSON      = "json"
+	logFormatEnv = "PLUMBER_LOG_FORMAT"
+)
+
+// What a log line is about. Fields that aren't set are left out. The
+// level is "error" if there's an error and "info" if it isn't set.
+type logFields struct {
+	Level     string
+	Pipeline  string
+	Bundle    string
+	RequestID string
+	Duration  time.Duration
+	Err       error
+}
+
+type logEntry struct {
+	Time      string   `json:"time"`
+	Level     string   `json:"level"`
+	Message   string   `json:"msg"`
+	Pipeline  string   `json:"pipeline,omitempty"`
+	Bundle    string   `json:"bundle,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+	Duration  *float64 `json:"duration_ms,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (f logFields) entry(msg string) logEntry {
+	e := logEntry{
+		Level:     "info",
+		Message:   msg,
+		Pipeline:  f.Pipeline,
+		Bundle:    f.Bundle,
+		RequestID: f.RequestID,
+	}
+	if f.Duration > 0 {
+		ms := float64(f.Duration) / float64(time.Millisecond)
+		e.Duration = &ms
+	}
+	if f.Err != nil {
+		e.Level, e.Error = "error", f.Err.Error()
+	}
+	if f.Level != "" {
+		e.Level = f.Level
+	}
+	return e
+}
+
+type jsonLogger struct {
+	sync.Mutex
+	out io.Writer
+}
+
+// Lines logged with the log package end up here, without any fields.
+func (l *jsonLogger) Write(p []byte) (int, error) {
+	l.write(logEntry{Level: "info", Message: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+func (l *jsonLogger) write(e logEntry) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// Set when we log JSON; nil when we log text.
+var structured *jsonLogger
+
+func defaultLogFormat() string {
+	if format := os.Getenv(logFormatEnv); format != "" {
+		return format
+	}
+	return logText
+}
+
+func setLogFormat(format string, out io.Writer) error {
+	switch format {
+	case logText:
+		structured = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(out)
+	case logJSON:
+		structured = &jsonLogger{out: out}
+		log.SetFlags(0)
+		log.SetOutput(structured)
+	default:
+		return fmt.Errorf("The log format must be '%s' or '%s', not '%s'.", logText, logJSON, format)
+	}
+	return nil
+}
+
+// Logs a message along with what it's about. Text logs leave the
+// fields out, so the message should mention anything important.
+func logEvent(f logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if structured == nil {
+		log.Print(msg)
+		return
+	}
+	structured.write(f.entry(msg))
+}
+
+// The bundle that made a record fail, if it was a bundle's fault.
+func failedBundle(err error) string {
+	if stageErr, ok := err.(*stageError); ok {
+		return stageErr.stage
+	}
+	return ""
+}
+
+// Logs how a record fared in the pipeline.
+func (p *pipeline) logRecord(t *trace, elapsed time.Duration, err error) {
+	fields := logFields{Pipeline: p.Name, Bundle: failedBundle(err), RequestID: t.requestID(), Duration: elapsed, Err: err}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	if err != nil {
+		logEvent(fields, "Record %s failed in %.1fms: %v", t.requestID(), ms, err)
+	} else {
+		logEvent(fields, "Record %s took %.1fms.", t.requestID(), ms)
+	}
+}
@@ -0,0 +1,101 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func readLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("'%s' is not JSON: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+			t.Errorf("'%s' has a bad time: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := &jsonLogger{out: buf}
+	l.Write([]byte("Reloaded 'pipeline.json'.\n"))
+	l.write(logFields{
+		Pipeline:  "foo",
+		Bundle:    "hello",
+		RequestID: "abc123",
+		Duration:  1500 * time.Microsecond,
+		Err:       errors.New("oops"),
+	}.entry("Record abc123 failed"))
+	l.write(logFields{}.entry("Stopped."))
+
+	lines := readLogLines(t, buf)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines", len(lines))
+	}
+	if lines[0]["msg"] != "Reloaded 'pipeline.json'." || lines[0]["level"] != "info" {
+		t.Errorf("unexpected line %v", lines[0])
+	}
+	expected := map[string]interface{}{
+		"level":       "error",
+		"msg":         "Record abc123 failed",
+		"pipeline":    "foo",
+		"bundle":      "hello",
+		"request_id":  "abc123",
+		"duration_ms": 1.5,
+		"error":       "oops",
+	}
+	for k, v := range expected {
+		if lines[1][k] != v {
+			t.Errorf("expected %s to be %v; got %v", k, v, lines[1][k])
+		}
+	}
+	for _, k := range []string{"pipeline", "bundle", "request_id", "duration_ms", "error"} {
+		if _, ok := lines[2][k]; ok {
+			t.Errorf("expected no %s in %v", k, lines[2])
+		}
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	if err := setLogFormat("xml", os.Stderr); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+	os.Setenv(logFormatEnv, logJSON)
+	defer os.Unsetenv(logFormatEnv)
+	if format := defaultLogFormat(); format != logJSON {
+		t.Errorf("got log format '%s' from the environment", format)
+	}
+}
+
+func TestFailedBundle(t *testing.T) {
+	if bundle := failedBundle(&stageError{stage: "hello", err: errors.New("oops")}); bundle != "hello" {
+		t.Errorf("got bundle '%s'", bundle)
+	}
+	if bundle := failedBundle(errors.New("oops")); bundle != "" {
+		t.Errorf("got bundle '%s' for an error that isn't a stage's", bundle)
+	}
+}
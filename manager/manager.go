@@ -16,49 +16,73 @@
 package main // import "github.com/qadium/plumber/manager"
 
 import (
-	"io"
-	"io/ioutil"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func forwardData(dest string, body io.ReadCloser) (io.ReadCloser, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", dest, body)
+func forwardData(client *http.Client, dest string, body []byte, requestID string, maxResponse int64) ([]byte, error) {
+	req, err := http.NewRequest("POST", dest, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req) // this will close the body, too
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
+	defer resp.Body.Close()
+	output, err := readLimited(resp.Body, maxResponse, "the response from the bundle")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &enhancerError{resp.StatusCode, strings.TrimSpace(string(output))}
+	}
+	return output, nil
 }
 
-func createHandler(args []string) func(w http.ResponseWriter, r *http.Request) {
+func createHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
 		if r.Body == nil || r.Method != "POST" {
 			http.NotFound(w, r)
 		} else {
-			body := r.Body
-			defer body.Close()
-
-			for _, host := range args {
-				body, err = forwardData(host, body)
-				if err != nil {
-					panic(err)
-				}
+			defer r.Body.Close()
+			p := source.current()
+			t := newTrace(requestID(r))
+			t.replay = r.Header.Get(replayHeader) != "" && p.trustsReplay(r)
+			w.Header().Set(requestIDHeader, t.id)
+			if err := p.limiter.acquire(); err != nil {
+				writeError(w, err)
+				return
+			}
+			defer p.limiter.release()
+			record, err := readLimited(r.Body, p.Limits.Request, "the record")
+			if sizeErr, ok := err.(*sizeError); ok {
+				writeError(w, tooLarge(sizeErr.what, sizeErr.limit))
+				return
+			} else if err != nil {
+				writeError(w, &requestError{http.StatusBadRequest, err.Error()})
+				return
 			}
 
-			final, err := ioutil.ReadAll(io.LimitReader(body, 1048576))
+			final, err := p.run(record, t)
+			t.writeHeaders(w)
 			if err != nil {
-				panic(err)
+				writeError(w, err)
+				return
 			}
 
 			w.Header().Set("Content-Type", "application/json")
@@ -67,35 +91,116 @@ func createHandler(args []string) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var (
+	configPath = flag.String("config", "", "a JSON description of the pipeline; reloaded on SIGHUP or when it changes")
+	tlsCert    = flag.String("tls-cert", "", "serve HTTPS with this certificate (needs -tls-key)")
+	tlsKey     = flag.String("tls-key", "", "the private key for -tls-cert")
+
+	drainDelay   = flag.Duration("drain-delay", 0, "how long to keep serving, while not ready, before shutting down")
+	drainTimeout = flag.Duration("drain-timeout", 20*time.Second, "how long to wait for requests in flight when shutting down")
+
+	logFormat = flag.String("log-format", defaultLogFormat(), "log 'text' or 'json'; defaults to $PLUMBER_LOG_FORMAT")
+
+	maxJobs       = flag.Int("max-jobs", 1000, "how many asynchronous jobs to keep")
+	jobTTL        = flag.Duration("job-ttl", time.Hour, "how long to keep finished jobs")
+	callbackHosts = flag.String("callback-hosts", "", "comma separated hosts that jobs may be posted back to; none if empty")
+)
+
+// The hosts in a comma separated list.
+func splitHosts(list string) []string {
+	hosts := []string{}
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Wraps the listener in TLS if we were given a certificate.
+func listenTLS(listener net.Listener, cert, key string) (net.Listener, error) {
+	if cert == "" && key == "" {
+		return listener, nil
+	}
+	if cert == "" || key == "" {
+		return nil, fmt.Errorf("Both -tls-cert and -tls-key are needed to serve HTTPS.")
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{pair}}), nil
+}
+
 func main() {
+	flag.Parse()
+	if err := setLogFormat(*logFormat, os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+	if *maxJobs < 1 {
+		log.Fatal("-max-jobs must be at least 1.")
+	}
+	var p *pipeline
+	var err error
+	if *configPath != "" {
+		p, err = loadConfig(*configPath)
+	} else {
+		p, err = parseArgs(flag.Args())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logPipeline(p)
+	live := newLivePipeline(p)
+
+	drain := newDrainer()
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	listener, err := net.Listen("tcp", ":9800")
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
+	if listener, err = listenTLS(listener, *tlsCert, *tlsKey); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/", requireAuth(live, createHandler(live)))
+	http.HandleFunc("/batch", requireAuth(live, createBatchHandler(live)))
+	http.HandleFunc("/stream", requireAuth(live, createStreamHandler(live)))
+	http.HandleFunc("/pipe", requireAuth(live, createPipeHandler(live)))
+	http.HandleFunc("/tap", requireAuth(live, createTapHandler(live, drain)))
+	jobs := requireAuth(live, createJobsHandler(live, newJobStore(*maxJobs, *jobTTL, splitHosts(*callbackHosts)), drain))
+	http.HandleFunc("/jobs", jobs)
+	http.HandleFunc("/jobs/", jobs)
+	admin := requireAdmin(live, createAdminHandler(live))
+	http.HandleFunc("/admin/stages", admin)
+	http.HandleFunc("/admin/stages/", admin)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", createHealthzHandler(live))
+	http.HandleFunc("/readyz", createReadyzHandler(live, drain))
+	server := &http.Server{Handler: drain.track(http.DefaultServeMux)}
 
+	stop := make(chan struct{})
+	done := make(chan struct{})
 	go func() {
-		<-c
-		log.Printf("Received termination; qutting.")
-		// by setting the exit status to 0, we don't cause any parent
-		// processes to think this was an unexpected termination
-		listener.Close()
+		sig := <-c
+		log.Printf("Received %v; draining requests for up to %v.", sig, *drainTimeout)
+		close(stop)
+		summary := shutdown(server, drain, *drainDelay, *drainTimeout)
+		logEvent(logFields{Duration: summary.elapsed}, "Served %d requests; %d were in flight when we stopped accepting new ones, along with %d jobs, and %d were cut off. Shutting down took %v.",
+			summary.served, summary.inFlight, summary.jobs, summary.dropped, summary.elapsed)
+		close(done)
 	}()
 
-	// sanitize args to make sure they contain valid urls
-	args := []string{}
-	for _, arg := range os.Args[1:] {
-		parsedUrl, err := url.Parse(arg)
-		if err == nil && parsedUrl.Scheme == "http" {
-			args = append(args, arg)
-		} else {
-			log.Printf("'%v' is not a valid url, discarding", arg)
-		}
+	if *configPath != "" {
+		live.watch(*configPath, configPollInterval, stop)
 	}
-	log.Printf("Forwarding JSONs to '%v'.", args)
 
-	http.HandleFunc("/", createHandler(args))
-	http.Serve(listener, nil)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// by exiting with status 0, we don't cause any parent processes to
+	// think this was an unexpected termination
+	<-done
 }
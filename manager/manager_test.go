@@ -17,16 +17,91 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 )
 
+// How newTestPipeline builds a pipeline. Tests only set the knobs they
+// care about.
+type testPipeline struct {
+	name     string
+	settings []string // more top-level fields, such as `"merge": {}`
+	urls     []string
+	stage    string // more fields for every stage in the chain
+	stages   string // the stages, instead of a chain of `urls`
+}
+
+type testOption func(*testPipeline)
+
+// Stages for each of the urls, named after their url, each depending
+// on the one before it.
+func withURLs(urls ...string) testOption {
+	return func(p *testPipeline) { p.urls = urls }
+}
+
+func withName(name string) testOption {
+	return func(p *testPipeline) { p.name = name }
+}
+
+// Adds top-level fields to the pipeline, formatted like fmt.Sprintf.
+func withSettings(format string, args ...interface{}) testOption {
+	return func(p *testPipeline) { p.settings = append(p.settings, fmt.Sprintf(format, args...)) }
+}
+
+// Adds fields to every stage of the chain, formatted like fmt.Sprintf.
+func withStageSettings(format string, args ...interface{}) testOption {
+	return func(p *testPipeline) { p.stage = fmt.Sprintf(format, args...) }
+}
+
+// Uses the given stages instead of a chain, formatted like fmt.Sprintf.
+func withStages(format string, args ...interface{}) testOption {
+	return func(p *testPipeline) { p.stages = fmt.Sprintf(format, args...) }
+}
+
+func newTestPipeline(t testing.TB, options ...testOption) *pipeline {
+	config := &testPipeline{}
+	for _, option := range options {
+		option(config)
+	}
+	stages := config.stages
+	if stages == "" {
+		chain := make([]string, len(config.urls))
+		for i, url := range config.urls {
+			fields := []string{fmt.Sprintf(`"name": %q, "url": %q`, url, url)}
+			if i > 0 {
+				fields = append(fields, fmt.Sprintf(`"depends": [%q]`, config.urls[i-1]))
+			}
+			if config.stage != "" {
+				fields = append(fields, config.stage)
+			}
+			chain[i] = "{" + strings.Join(fields, ", ") + "}"
+		}
+		stages = strings.Join(chain, ", ")
+	}
+	fields := append([]string{fmt.Sprintf(`"name": %q, "stages": [%s]`, config.name, stages)}, config.settings...)
+	p, err := parsePipeline([]byte("{" + strings.Join(fields, ", ") + "}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Posts `body` to the handler at `path`.
+func post(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
 // Test that the handler with no args just returns the data sent
 func TestHandlerNoArgs(t *testing.T) {
-	handler := createHandler(nil)
+	handler := createHandler(newTestPipeline(t))
 
 	req, err := http.NewRequest("POST", "http://example.com/foo", bytes.NewBufferString("{'foo': 3}"))
 	if err != nil {
@@ -44,7 +119,7 @@ func TestHandlerNoArgs(t *testing.T) {
 // Test that the handler with no args returns 404 if we try a GET or
 // POST with no data
 func TestHandlerInvalidRequest(t *testing.T) {
-	handler := createHandler(nil)
+	handler := createHandler(newTestPipeline(t))
 
 	req, err := http.NewRequest("GET", "http://foobar.com", nil)
 	if err != nil {
@@ -84,7 +159,7 @@ func TestHandlerForwardsData(t *testing.T) {
 	ts2 := httptest.NewServer(http.HandlerFunc(makeTestHandler("first")))
 	defer ts2.Close()
 
-	handler := createHandler([]string{ts1.URL, ts2.URL})
+	handler := createHandler(newTestPipeline(t, withURLs(ts1.URL, ts2.URL)))
 	req, err := http.NewRequest("POST", "http://foobar.com", bytes.NewBufferString("{'foo': 3}"))
 	if err != nil {
 		t.Error(err)
@@ -123,7 +198,7 @@ func TestMainRunnerExitsGracefully(t *testing.T) {
 // Obviously, this is not accurate in production since we forward to
 // multiple handlers.
 func BenchmarkHandler(b *testing.B) {
-	handler := createHandler(nil)
+	handler := createHandler(newTestPipeline(b))
 
 	req, err := http.NewRequest("POST", "http://example.com/foo", bytes.NewBufferString("{'foo': 3}"))
 	if err != nil {
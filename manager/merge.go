@@ -0,0 +1,176 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// What to do when a bundle outputs a field that's already in the
+// record with a different value.
+const (
+	conflictsError     = "error"      // fail the record
+	conflictsFirstWins = "first-wins" // keep the value we already had
+	conflictsLastWins  = "last-wins"  // use the new value
+)
+
+// By default, the manager passes records from stage to stage as they
+// are. With a merge policy, the manager builds the record itself: every
+// field a bundle was sent stays in the record, and only the outputs
+// the bundle declares are taken from its response.
+type mergePolicy struct {
+	Conflicts string `json:"conflicts,omitempty"`
+	Strict    bool   `json:"strict,omitempty"`  // fail records when a bundle outputs fields it didn't declare
+	Project   bool   `json:"project,omitempty"` // only send each bundle the inputs it declares
+}
+
+func (m *mergePolicy) init() error {
+	switch m.Conflicts {
+	case "":
+		m.Conflicts = conflictsLastWins
+	case conflictsError, conflictsFirstWins, conflictsLastWins:
+	default:
+		return fmt.Errorf("'conflicts' must be one of '%s', '%s' or '%s', not '%s'.",
+			conflictsError, conflictsFirstWins, conflictsLastWins, m.Conflicts)
+	}
+	return nil
+}
+
+type fields map[string]json.RawMessage
+
+// Values are compacted, so we can compare them byte for byte.
+func decodeFields(record []byte) (fields, error) {
+	f := make(fields)
+	if err := json.Unmarshal(record, &f); err != nil {
+		return nil, err
+	}
+	for k, v := range f {
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, v); err != nil {
+			return nil, err
+		}
+		f[k] = buf.Bytes()
+	}
+	return f, nil
+}
+
+// Sets a field according to the conflict policy. Returns false if the
+// policy is "error" and the field already has a different value.
+func (m *mergePolicy) set(f fields, name string, value json.RawMessage) bool {
+	old, ok := f[name]
+	if !ok || bytes.Equal(old, value) {
+		f[name] = value
+		return true
+	}
+	switch m.Conflicts {
+	case conflictsError:
+		return false
+	case conflictsLastWins:
+		f[name] = value
+	}
+	return true
+}
+
+// Merges the outputs of the stages at `indices` (into `p.order`), in
+// pipeline order. If fields conflict, the error names the stage whose
+// output conflicted.
+func (p *pipeline) mergeOutputs(indices []int, outputs [][]byte) ([]byte, error) {
+	sorted := append([]int(nil), indices...)
+	sort.Ints(sorted)
+
+	merged := make(fields)
+	owners := make(map[string]string)
+	for _, i := range sorted {
+		s := p.order[i]
+		f, err := decodeFields(outputs[i])
+		if err != nil {
+			return nil, &stageError{s.Name, http.StatusBadGateway, fmt.Errorf("could not merge output: %v", err), nil}
+		}
+		names := make([]string, 0, len(f))
+		for name := range f {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !p.Merge.set(merged, name, f[name]) {
+				return nil, &stageError{s.Name, http.StatusBadGateway,
+					fmt.Errorf("output field '%s' conflicts with the value from '%s'", name, owners[name]), nil}
+			}
+			if _, ok := owners[name]; !ok {
+				owners[name] = s.Name
+			}
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// The part of the record the stage declares as inputs. Inputs missing
+// from the record are left out, so the bundle can complain about them.
+func project(s *stage, record []byte) ([]byte, error) {
+	f := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(record, &f); err != nil {
+		return nil, newStageError(s, fmt.Errorf("could not select inputs: %v", err), record)
+	}
+	inputs := make(map[string]json.RawMessage, len(s.Inputs))
+	for _, name := range s.Inputs {
+		if value, ok := f[name]; ok {
+			inputs[name] = value
+		}
+	}
+	return json.Marshal(inputs)
+}
+
+// Adds the outputs the stage declared to the record it was sent.
+func (m *mergePolicy) apply(s *stage, input, output []byte) ([]byte, error) {
+	record, err := decodeFields(input)
+	if err != nil {
+		return nil, newStageError(s, fmt.Errorf("could not merge output: %v", err), input)
+	}
+	result, err := decodeFields(output)
+	if err != nil {
+		return nil, newStageError(s, fmt.Errorf("could not merge output: %v", err), input)
+	}
+
+	declared := make(map[string]bool)
+	for _, name := range s.Outputs {
+		declared[name] = true
+		value, ok := result[name]
+		if !ok {
+			continue
+		}
+		if !m.set(record, name, value) {
+			return nil, newStageError(s, fmt.Errorf("output field '%s' conflicts with the value it was sent", name), input)
+		}
+	}
+
+	if m.Strict {
+		undeclared := []string{}
+		for name, value := range result {
+			if old, ok := record[name]; !declared[name] && (!ok || !bytes.Equal(old, value)) {
+				undeclared = append(undeclared, name)
+			}
+		}
+		if len(undeclared) > 0 {
+			sort.Strings(undeclared)
+			return nil, newStageError(s, fmt.Errorf("undeclared output fields %v", undeclared), input)
+		}
+	}
+	return json.Marshal(record)
+}
@@ -0,0 +1,132 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// An enhancer that ignores its input and always responds with the same
+// record.
+func makeFixedEnhancer(response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+}
+
+func TestMergeKeepsInputs(t *testing.T) {
+	ts := makeFixedEnhancer(`{"x": 1, "junk": true}`)
+	defer ts.Close()
+	stages := withStages(`{"name": "a", "url": %q, "outputs": ["x"]}`, ts.URL)
+
+	p := newTestPipeline(t, withSettings(`"merge": {}`), stages)
+	w := post(createHandler(p), "/", `{"a": "b"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"a":"b","x":1}` {
+		t.Errorf("unexpected response %d '%s'", w.Code, w.Body.String())
+	}
+
+	p = newTestPipeline(t, withSettings(`"merge": {"strict": true}`), stages)
+	w = post(createHandler(p), "/", `{"a": "b"}`)
+	details := decodeError(t, w)
+	if w.Code != http.StatusBadGateway || details.Bundle != "a" || !strings.Contains(details.Message, "junk") {
+		t.Errorf("strict mode did not reject undeclared output: %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	ts := makeFixedEnhancer(`{"x": 1}`)
+	defer ts.Close()
+	stages := withStages(`{"name": "a", "url": %q, "outputs": ["x"]}`, ts.URL)
+
+	cases := []struct {
+		conflicts string
+		expected  string
+	}{
+		{"last-wins", `{"x":1}`},
+		{"first-wins", `{"x":0}`},
+	}
+	for _, c := range cases {
+		p := newTestPipeline(t, withSettings(`"merge": {"conflicts": %q}`, c.conflicts), stages)
+		if w := post(createHandler(p), "/", `{"x": 0}`); w.Body.String() != c.expected {
+			t.Errorf("%s: expected '%s', got '%s'", c.conflicts, c.expected, w.Body.String())
+		}
+	}
+
+	p := newTestPipeline(t, withSettings(`"merge": {"conflicts": "error"}`), stages)
+	if w := post(createHandler(p), "/", `{"x": 0}`); w.Code != http.StatusBadGateway {
+		t.Errorf("conflict did not fail the record: %d '%s'", w.Code, w.Body.String())
+	}
+	// the same value isn't a conflict
+	if w := post(createHandler(p), "/", `{"x": 1}`); w.Code != http.StatusOK {
+		t.Errorf("identical value failed the record: %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestMergeConflictsBetweenStages(t *testing.T) {
+	a := makeFixedEnhancer(`{"y": "a"}`)
+	defer a.Close()
+	b := makeFixedEnhancer(`{"y": "b"}`)
+	defer b.Close()
+	stages := withStages(`{"name": "a", "url": %q, "outputs": ["y"]}, {"name": "b", "url": %q, "outputs": ["y"]}`, a.URL, b.URL)
+
+	p := newTestPipeline(t, withSettings(`"merge": {"conflicts": "first-wins"}`), stages)
+	w := post(createHandler(p), "/", `{}`)
+	if w.Body.String() != `{"y":"a"}` {
+		t.Errorf("expected the first stage to win, got '%s'", w.Body.String())
+	}
+	p = newTestPipeline(t, withSettings(`"merge": {"conflicts": "last-wins"}`), stages)
+	w = post(createHandler(p), "/", `{}`)
+	if w.Body.String() != `{"y":"b"}` {
+		t.Errorf("expected the last stage to win, got '%s'", w.Body.String())
+	}
+	p = newTestPipeline(t, withSettings(`"merge": {"conflicts": "error"}`), stages)
+	w = post(createHandler(p), "/", `{}`)
+	details := decodeError(t, w)
+	if w.Code != http.StatusBadGateway || details.Bundle != "b" || !strings.Contains(details.Message, "'a'") {
+		t.Errorf("unexpected response %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestMergePolicyInvalid(t *testing.T) {
+	_, err := parsePipeline([]byte(`{"merge": {"conflicts": "sometimes"}, "stages": []}`))
+	if err == nil {
+		t.Error("expected an error for an unknown conflict policy")
+	}
+}
+
+func TestMergeProjectsInputs(t *testing.T) {
+	var sent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sent = string(body)
+		w.Write([]byte(`{"name": "n", "wide": "ignored"}`))
+	}))
+	defer ts.Close()
+	stages := withStages(`{"name": "a", "url": %q, "inputs": ["hostname", "missing"], "outputs": ["name"]}`, ts.URL)
+
+	p := newTestPipeline(t, withSettings(`"merge": {"project": true}`), stages)
+	w := post(createHandler(p), "/", `{"hostname": "h", "wide": [1, 2, 3]}`)
+	if sent != `{"hostname":"h"}` {
+		t.Errorf("bundle was sent '%s'; expected only its inputs", sent)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != `{"hostname":"h","name":"n","wide":[1,2,3]}` {
+		t.Errorf("unexpected response %d '%s'", w.Code, w.Body.String())
+	}
+}
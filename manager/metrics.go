@@ -0,0 +1,307 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed at /metrics in the Prometheus text format. We
+// write the format ourselves so the manager only needs the standard
+// library.
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] is the number of observations <= bounds[i] but > bounds[i-1]
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(buf *bytes.Buffer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(buf, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(buf, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// Metrics for requests from the manager to a single stage.
+type stageMetrics struct {
+	sync.Mutex
+	requests      uint64
+	errors        uint64
+	inFlight      int64
+	cacheHits     uint64
+	cacheMisses   uint64
+	skips         uint64
+	shadowMatches uint64
+	shadowDiffs   uint64
+	shadowErrors  uint64
+	latency       *histogram
+	requestSize   *histogram
+	responseSize  *histogram
+}
+
+// Called before sending a request of `size` bytes to the stage. The
+// size is negative if we don't know it.
+func (m *stageMetrics) begin(size int) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests++
+	m.inFlight++
+	if size >= 0 {
+		m.requestSize.observe(float64(size))
+	}
+}
+
+// Called when the stage has responded with `size` bytes.
+func (m *stageMetrics) end(elapsed time.Duration, size int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.inFlight--
+	m.latency.observe(elapsed.Seconds())
+	if err != nil {
+		m.errors++
+	} else if size >= 0 {
+		m.responseSize.observe(float64(size))
+	}
+}
+
+// Called when we look up a record in the stage's cache.
+func (m *stageMetrics) cached(hit bool) {
+	m.Lock()
+	defer m.Unlock()
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+// Called when a record skips the stage because it's missing an input.
+func (m *stageMetrics) skipped() {
+	m.Lock()
+	defer m.Unlock()
+	m.skips++
+}
+
+// Called once a record mirrored to the stage's candidate has been
+// compared.
+func (m *stageMetrics) shadowed(result *shadowResult) {
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case result.CandidateError != "" && result.Error == "":
+		m.shadowErrors++
+	case result.Match:
+		m.shadowMatches++
+	default:
+		m.shadowDiffs++
+	}
+}
+
+// Metrics for records sent through a pipeline.
+type pipelineMetrics struct {
+	sync.Mutex
+	records uint64
+	errors  uint64
+	latency *histogram
+}
+
+func (m *pipelineMetrics) observe(elapsed time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.records++
+	if err != nil {
+		m.errors++
+	}
+	m.latency.observe(elapsed.Seconds())
+}
+
+type stageKey struct {
+	pipeline string
+	bundle   string
+}
+
+// Metrics are kept here rather than on the pipeline, so they survive
+// the pipeline being replaced.
+type metricsRegistry struct {
+	sync.Mutex
+	stages    map[stageKey]*stageMetrics
+	pipelines map[string]*pipelineMetrics
+}
+
+var registry = &metricsRegistry{
+	stages:    make(map[stageKey]*stageMetrics),
+	pipelines: make(map[string]*pipelineMetrics),
+}
+
+func (r *metricsRegistry) stage(pipeline, bundle string) *stageMetrics {
+	r.Lock()
+	defer r.Unlock()
+	key := stageKey{pipeline, bundle}
+	if _, ok := r.stages[key]; !ok {
+		r.stages[key] = &stageMetrics{
+			latency:      newHistogram(latencyBuckets),
+			requestSize:  newHistogram(sizeBuckets),
+			responseSize: newHistogram(sizeBuckets),
+		}
+	}
+	return r.stages[key]
+}
+
+func (r *metricsRegistry) pipeline(pipeline string) *pipelineMetrics {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.pipelines[pipeline]; !ok {
+		r.pipelines[pipeline] = &pipelineMetrics{latency: newHistogram(latencyBuckets)}
+	}
+	return r.pipelines[pipeline]
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func header(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes every metric in the Prometheus text format.
+func (r *metricsRegistry) write(buf *bytes.Buffer) {
+	r.Lock()
+	defer r.Unlock()
+
+	pipelines := make([]string, 0, len(r.pipelines))
+	for name := range r.pipelines {
+		pipelines = append(pipelines, name)
+	}
+	sort.Strings(pipelines)
+	pipelineLabels := func(name string) string {
+		return fmt.Sprintf(`pipeline="%s"`, labelEscaper.Replace(name))
+	}
+
+	header(buf, "plumber_records_total", "counter", "Records sent through the pipeline.")
+	for _, name := range pipelines {
+		m := r.pipelines[name]
+		m.Lock()
+		fmt.Fprintf(buf, "plumber_records_total{%s} %d\n", pipelineLabels(name), m.records)
+		m.Unlock()
+	}
+	header(buf, "plumber_record_errors_total", "counter", "Records that failed in the pipeline.")
+	for _, name := range pipelines {
+		m := r.pipelines[name]
+		m.Lock()
+		fmt.Fprintf(buf, "plumber_record_errors_total{%s} %d\n", pipelineLabels(name), m.errors)
+		m.Unlock()
+	}
+	header(buf, "plumber_record_latency_seconds", "histogram", "Time taken to send a record through the pipeline.")
+	for _, name := range pipelines {
+		m := r.pipelines[name]
+		m.Lock()
+		m.latency.write(buf, "plumber_record_latency_seconds", pipelineLabels(name))
+		m.Unlock()
+	}
+
+	keys := make([]stageKey, 0, len(r.stages))
+	for key := range r.stages {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pipeline != keys[j].pipeline {
+			return keys[i].pipeline < keys[j].pipeline
+		}
+		return keys[i].bundle < keys[j].bundle
+	})
+	stageLabels := func(key stageKey) string {
+		return fmt.Sprintf(`pipeline="%s",bundle="%s"`, labelEscaper.Replace(key.pipeline), labelEscaper.Replace(key.bundle))
+	}
+
+	stageMetric := func(name, kind, help string, write func(m *stageMetrics, labels string)) {
+		header(buf, name, kind, help)
+		for _, key := range keys {
+			m := r.stages[key]
+			m.Lock()
+			write(m, stageLabels(key))
+			m.Unlock()
+		}
+	}
+	stageMetric("plumber_stage_requests_total", "counter", "Requests sent to the bundle.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_requests_total{%s} %d\n", labels, m.requests)
+	})
+	stageMetric("plumber_stage_errors_total", "counter", "Requests to the bundle that failed.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_errors_total{%s} %d\n", labels, m.errors)
+	})
+	stageMetric("plumber_stage_in_flight", "gauge", "Requests to the bundle that have not finished.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_in_flight{%s} %d\n", labels, m.inFlight)
+	})
+	stageMetric("plumber_stage_cache_hits_total", "counter", "Records whose outputs were found in the bundle's cache.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_cache_hits_total{%s} %d\n", labels, m.cacheHits)
+	})
+	stageMetric("plumber_stage_cache_misses_total", "counter", "Records whose outputs were not in the bundle's cache.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_cache_misses_total{%s} %d\n", labels, m.cacheMisses)
+	})
+	stageMetric("plumber_stage_skipped_total", "counter", "Records that skipped the bundle because they were missing an input.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_skipped_total{%s} %d\n", labels, m.skips)
+	})
+	stageMetric("plumber_stage_shadow_total", "counter", "Records mirrored to the bundle's candidate, by how its output compared.", func(m *stageMetrics, labels string) {
+		fmt.Fprintf(buf, "plumber_stage_shadow_total{%s,result=\"match\"} %d\n", labels, m.shadowMatches)
+		fmt.Fprintf(buf, "plumber_stage_shadow_total{%s,result=\"diff\"} %d\n", labels, m.shadowDiffs)
+		fmt.Fprintf(buf, "plumber_stage_shadow_total{%s,result=\"error\"} %d\n", labels, m.shadowErrors)
+	})
+	stageMetric("plumber_stage_latency_seconds", "histogram", "Time taken by the bundle to respond.", func(m *stageMetrics, labels string) {
+		m.latency.write(buf, "plumber_stage_latency_seconds", labels)
+	})
+	stageMetric("plumber_stage_request_bytes", "histogram", "Size of the records sent to the bundle.", func(m *stageMetrics, labels string) {
+		m.requestSize.write(buf, "plumber_stage_request_bytes", labels)
+	})
+	stageMetric("plumber_stage_response_bytes", "histogram", "Size of the records returned by the bundle.", func(m *stageMetrics, labels string) {
+		m.responseSize.write(buf, "plumber_stage_response_bytes", labels)
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	registry.write(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
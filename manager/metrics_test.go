@@ -0,0 +1,81 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	}))
+	defer broken.Close()
+
+	// the registry outlives the test, so every run gets its own pipeline
+	name := fmt.Sprintf("metrics-test-%d", time.Now().UnixNano())
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "%s", "stages": [
+		{"name": "a", "url": "%s"},
+		{"name": "b\"c", "url": "%s", "depends": ["a"]}]}`, name, ok.URL, broken.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		post(createHandler(p), "/", `{"foo": 3}`)
+	}
+
+	req, _ := http.NewRequest("GET", "http://foobar.com/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsHandler(w, req)
+
+	metrics := w.Body.String()
+	expected := []string{
+		"# TYPE plumber_stage_latency_seconds histogram",
+		`plumber_records_total{pipeline="metrics-test"} 3`,
+		`plumber_record_errors_total{pipeline="metrics-test"} 3`,
+		`plumber_stage_requests_total{pipeline="metrics-test",bundle="a"} 3`,
+		`plumber_stage_errors_total{pipeline="metrics-test",bundle="a"} 0`,
+		`plumber_stage_errors_total{pipeline="metrics-test",bundle="b\"c"} 3`,
+		`plumber_stage_in_flight{pipeline="metrics-test",bundle="a"} 0`,
+		`plumber_stage_latency_seconds_count{pipeline="metrics-test",bundle="a"} 3`,
+		`plumber_stage_request_bytes_bucket{pipeline="metrics-test",bundle="a",le="256"} 3`,
+		`plumber_stage_response_bytes_bucket{pipeline="metrics-test",bundle="a",le="+Inf"} 3`,
+		`plumber_stage_response_bytes_count{pipeline="metrics-test",bundle="b\"c"} 0`,
+	}
+	for _, line := range expected {
+		line = strings.Replace(line, `pipeline="metrics-test"`, fmt.Sprintf(`pipeline="%s"`, name), 1)
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Metrics: did not find '%s' in:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1, 1.5, 3} {
+		h.observe(v)
+	}
+	if fmt.Sprint(h.counts) != "[2 1]" || h.count != 4 || h.sum != 6 {
+		t.Errorf("Histogram: got counts %v, count %d and sum %g", h.counts, h.count, h.sum)
+	}
+}
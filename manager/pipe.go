@@ -0,0 +1,158 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// For records too large to hold in memory, /pipe streams the request
+// body to the first stage, each stage's response to the next stage and
+// the last response back to the caller, without buffering any of them.
+// Since we never have the whole record, this only works for pipelines
+// that are a single chain of stages and don't merge outputs, and stages
+// are never retried or skipped.
+
+// Sends `body` to the stage and returns the body of its response once
+// the headers arrive, limited to the stage's response limit.
+func (s *stage) open(body io.Reader, t *trace) (*limitedReader, io.Closer, error) {
+	// as in `call`, the breaker is asked last, so that its trial
+	// request is only taken by a request we then send
+	if err := s.limiter.acquire(); err != nil {
+		return nil, nil, newStageError(s, err, nil)
+	}
+	e := s.balancer.pick()
+	req, err := http.NewRequest("POST", e.url, newLimitedReader(body, s.Limits.Request, "the record sent to the bundle"))
+	if err != nil {
+		s.balancer.done(e, nil)
+		s.limiter.release()
+		return nil, nil, newStageError(s, err, nil)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := t.requestID(); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if err := s.breaker.allow(); err != nil {
+		s.balancer.done(e, nil)
+		s.limiter.release()
+		return nil, nil, newStageError(s, err, nil)
+	}
+
+	s.metrics.begin(-1)
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	s.limiter.release()
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		message, _ := readLimited(resp.Body, s.Limits.Response, "the response from the bundle")
+		resp.Body.Close()
+		err = &enhancerError{resp.StatusCode, strings.TrimSpace(string(message))}
+	}
+	// the response is still streaming, but as far as the balancer is
+	// concerned, the endpoint is done
+	s.balancer.done(e, err)
+	s.metrics.end(time.Since(start), -1, err)
+	t.observe(s.Name, time.Since(start))
+
+	// a record that's too large doesn't mean the enhancer is down, but
+	// it does have to give back the breaker's trial request
+	var sizeErr *sizeError
+	if errors.As(err, &sizeErr) {
+		s.breaker.record(nil)
+		return nil, nil, newStageError(s, sizeErr, nil)
+	}
+	if retryable(err) {
+		s.breaker.record(err)
+	} else {
+		s.breaker.record(nil)
+	}
+	if err != nil {
+		return nil, nil, newStageError(s, err, nil)
+	}
+	return newLimitedReader(resp.Body, s.Limits.Response, "the response from the bundle"), resp.Body, nil
+}
+
+// Streams `body` through every stage in turn. The caller must close the
+// returned closer.
+func (p *pipeline) pipe(body io.Reader, t *trace) (io.Reader, io.Closer, error) {
+	var output io.Reader = body
+	var closer io.Closer = io.NopCloser(nil)
+	for i, s := range p.order {
+		response, responseCloser, err := s.open(output, t)
+		// the stage has read all of its input once it responds
+		closer.Close()
+		if err != nil {
+			// if the previous stage sent too much, it's to blame
+			if previous, ok := output.(*limitedReader); ok && i > 0 && previous.err != nil {
+				err = newStageError(p.order[i-1], previous.err, nil)
+			}
+			return nil, nil, err
+		}
+		output, closer = response, responseCloser
+	}
+	return output, closer, nil
+}
+
+func createPipeHandler(source pipelineSource) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		defer r.Body.Close()
+		p := source.current()
+		t := newTrace(requestID(r))
+		w.Header().Set(requestIDHeader, t.id)
+		if !p.chain || p.Merge != nil {
+			writeError(w, &requestError{http.StatusBadRequest, "Only pipelines that are a single chain of stages without a merge policy can stream records."})
+			return
+		}
+		if err := p.limiter.acquire(); err != nil {
+			writeError(w, err)
+			return
+		}
+		defer p.limiter.release()
+
+		start := time.Now()
+		body := newLimitedReader(r.Body, p.Limits.Request, "the record")
+		output, closer, err := p.pipe(body, t)
+		if err != nil {
+			p.metrics.observe(time.Since(start), err)
+			t.writeHeaders(w)
+			if body.err != nil {
+				err = tooLarge(body.err.what, body.err.limit)
+			}
+			p.logRecord(t, time.Since(start), err)
+			writeError(w, err)
+			return
+		}
+		defer closer.Close()
+
+		t.writeHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = io.Copy(w, newLimitedReader(output, p.Limits.Response, "the response"))
+		p.metrics.observe(time.Since(start), err)
+		p.logRecord(t, time.Since(start), err)
+		if err != nil {
+			// we've already sent part of the response, so all we can do
+			// is make sure the caller doesn't mistake it for all of it
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
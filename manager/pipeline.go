@@ -0,0 +1,514 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A stage is a single enhancer in the pipeline. It depends on the
+// stages named in `Depends`; these must complete before this stage is
+// run.
+type stage struct {
+	Name      string          `json:"name"`
+	URL       string          `json:"url,omitempty"`
+	URLs      []string        `json:"urls,omitempty"` // replicas of the bundle, instead of `URL`
+	Balance   balancePolicy   `json:"balance"`
+	Depends   []string        `json:"depends,omitempty"`
+	Inputs    []string        `json:"inputs,omitempty"` // the fields the bundle declares; see mergePolicy
+	Outputs   []string        `json:"outputs,omitempty"`
+	Optional  []string        `json:"optional,omitempty"` // the inputs the bundle can do without
+	Policy    policy          `json:"policy"`
+	Limits    limits          `json:"limits"`
+	Cache     *cachePolicy    `json:"cache,omitempty"`
+	Admission admissionPolicy `json:"admission"`
+	Shadow    *shadowPolicy   `json:"shadow,omitempty"` // a candidate version of the bundle
+	Image     string          `json:"image,omitempty"`  // the version of the bundle, for lineage
+
+	parents  []int // indices (into pipeline.order) of our dependencies
+	sink     bool  // true if no other stage depends on this one
+	client   *http.Client
+	breaker  *breaker
+	balancer *balancer
+	cache    *resultCache
+	limiter  *limiter
+	metrics  *stageMetrics
+	shadow   *shadow
+}
+
+// A pipeline is a DAG of stages. This is what `plumber start` hands to
+// the manager.
+type pipeline struct {
+	Name          string          `json:"name,omitempty"`
+	Stages        []*stage        `json:"stages"`
+	Concurrency   int             `json:"concurrency,omitempty"`   // records in flight per batch or stream
+	DeadLetterDir string          `json:"deadLetterDir,omitempty"` // where to keep records that fail
+	ShadowDir     string          `json:"shadowDir,omitempty"`     // where to keep shadow results
+	Merge         *mergePolicy    `json:"merge,omitempty"`
+	Limits        limits          `json:"limits"`
+	Admission     admissionPolicy `json:"admission"`
+	Record        *recordPolicy   `json:"record,omitempty"` // where to record traffic
+	Auth          *authPolicy     `json:"auth,omitempty"`
+	Admin         *authPolicy     `json:"admin,omitempty"`       // who can use the admin API
+	EnhancerTLS   *tlsPolicy      `json:"enhancerTLS,omitempty"` // how to connect to https enhancers
+	Lineage       bool            `json:"lineage,omitempty"`     // add `_plumber` to every result
+
+	order       []*stage // the stages in topologically sorted order
+	chain       bool     // true if each stage depends on the one before it
+	limiter     *limiter
+	metrics     *pipelineMetrics
+	deadLetters *deadLetterStore
+	recorder    *recorder
+	shadows     *shadowStore
+	transport   http.RoundTripper // nil for the default
+	probeClient *http.Client
+}
+
+// Checks the pipeline's stages and sorts them so that every stage
+// comes after its dependencies. Stages that don't depend on each other
+// keep the order they were declared in.
+func (p *pipeline) init() error {
+	p.metrics = registry.pipeline(p.Name)
+	if err := p.Limits.init(limits{defaultMaxRecordSize, defaultMaxRecordSize}); err != nil {
+		return fmt.Errorf("Pipeline '%s' has invalid limits: %v", p.Name, err)
+	}
+	if err := p.Admission.init(); err != nil {
+		return fmt.Errorf("Pipeline '%s' has an invalid admission policy: %v", p.Name, err)
+	}
+	p.limiter = newLimiter(p.Admission, http.StatusTooManyRequests, "the pipeline")
+	if p.Merge != nil {
+		if err := p.Merge.init(); err != nil {
+			return fmt.Errorf("Pipeline '%s' has an invalid merge policy: %v", p.Name, err)
+		}
+	}
+	if p.DeadLetterDir != "" {
+		var err error
+		if p.deadLetters, err = newDeadLetterStore(p.DeadLetterDir); err != nil {
+			return err
+		}
+	}
+	if p.ShadowDir != "" {
+		var err error
+		if p.shadows, err = newShadowStore(p.ShadowDir); err != nil {
+			return err
+		}
+	}
+	if p.Record != nil {
+		if err := p.Record.init(); err != nil {
+			return fmt.Errorf("Pipeline '%s' has an invalid recording: %v", p.Name, err)
+		}
+		var err error
+		if p.recorder, err = newRecorder(p.Record); err != nil {
+			return err
+		}
+	}
+	if p.Auth != nil {
+		if err := p.Auth.init(); err != nil {
+			return fmt.Errorf("Pipeline '%s' has an invalid auth policy: %v", p.Name, err)
+		}
+	}
+	if p.Admin != nil {
+		if err := p.Admin.init(); err != nil {
+			return fmt.Errorf("Pipeline '%s' has an invalid admin policy: %v", p.Name, err)
+		}
+		if len(p.Admin.APIKeys) == 0 && len(p.Admin.Tokens) == 0 {
+			return fmt.Errorf("Pipeline '%s' needs an API key or token for the admin API.", p.Name)
+		}
+	}
+	var err error
+	if p.transport, err = p.EnhancerTLS.transport(); err != nil {
+		return fmt.Errorf("Pipeline '%s' has an invalid enhancer TLS config: %v", p.Name, err)
+	}
+	p.probeClient = &http.Client{Timeout: probeTimeout, Transport: p.transport}
+	index := make(map[string]int)
+	for i, s := range p.Stages {
+		if s.Name == "" {
+			return fmt.Errorf("Stage %d is missing a 'name'.", i)
+		}
+		if _, ok := index[s.Name]; ok {
+			return fmt.Errorf("Stage '%s' is declared more than once.", s.Name)
+		}
+		urls := s.URLs
+		if s.URL != "" {
+			if len(s.URLs) > 0 {
+				return fmt.Errorf("Stage '%s' has both a 'url' and 'urls'.", s.Name)
+			}
+			urls = []string{s.URL}
+		}
+		if len(urls) == 0 {
+			return fmt.Errorf("Stage '%s' does not have a 'url'.", s.Name)
+		}
+		for _, u := range urls {
+			parsedUrl, err := url.Parse(u)
+			if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+				return fmt.Errorf("Stage '%s' does not have a valid url: '%s'.", s.Name, u)
+			}
+		}
+		if err := s.Balance.init(); err != nil {
+			return fmt.Errorf("Stage '%s' has an invalid balance policy: %v", s.Name, err)
+		}
+		if s.balancer, err = newBalancer(s.Name, urls, s.Balance); err != nil {
+			return err
+		}
+		if err := s.Policy.init(); err != nil {
+			return fmt.Errorf("Stage '%s' has an invalid policy: %v", s.Name, err)
+		}
+		if err := s.Limits.init(p.Limits); err != nil {
+			return fmt.Errorf("Stage '%s' has invalid limits: %v", s.Name, err)
+		}
+		if s.Cache != nil {
+			if err := s.Cache.init(); err != nil {
+				return fmt.Errorf("Stage '%s' has an invalid cache: %v", s.Name, err)
+			}
+		}
+		s.cache = newResultCache(s.Cache)
+		if err := s.Admission.init(); err != nil {
+			return fmt.Errorf("Stage '%s' has an invalid admission policy: %v", s.Name, err)
+		}
+		s.limiter = newLimiter(s.Admission, http.StatusServiceUnavailable, "the bundle")
+		s.client = &http.Client{Timeout: s.Policy.timeout, Transport: p.transport}
+		s.breaker = newBreaker(s.Policy.Breaker)
+		s.metrics = registry.stage(p.Name, s.Name)
+		if s.Shadow != nil {
+			if err := s.Shadow.init(); err != nil {
+				return fmt.Errorf("Stage '%s' has an invalid shadow: %v", s.Name, err)
+			}
+			s.shadow = newShadow(p, s)
+		}
+		index[s.Name] = i
+	}
+
+	// Kahn's algorithm
+	children := make([][]int, len(p.Stages))
+	indegree := make([]int, len(p.Stages))
+	for i, s := range p.Stages {
+		for _, dep := range s.Depends {
+			j, ok := index[dep]
+			if !ok {
+				return fmt.Errorf("Stage '%s' depends on unknown stage '%s'.", s.Name, dep)
+			}
+			children[j] = append(children[j], i)
+			indegree[i]++
+		}
+	}
+
+	p.order = make([]*stage, 0, len(p.Stages))
+	position := make([]int, len(p.Stages))
+	for len(p.order) < len(p.Stages) {
+		next := -1
+		for i := range p.Stages {
+			if indegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return fmt.Errorf("Pipeline '%s' is not a DAG!", p.Name)
+		}
+		indegree[next] = -1
+		for _, child := range children[next] {
+			indegree[child]--
+		}
+		position[next] = len(p.order)
+		p.order = append(p.order, p.Stages[next])
+	}
+
+	for i, s := range p.Stages {
+		s.parents = make([]int, len(s.Depends))
+		for k, dep := range s.Depends {
+			s.parents[k] = position[index[dep]]
+		}
+		s.sink = len(children[i]) == 0
+	}
+
+	p.chain = true
+	for i, s := range p.order {
+		if (i == 0 && len(s.parents) != 0) || (i > 0 && (len(s.parents) != 1 || s.parents[0] != i-1)) {
+			p.chain = false
+		}
+	}
+	return nil
+}
+
+// Creates a pipeline that runs the given urls one after another.
+func newChainPipeline(urls []string) (*pipeline, error) {
+	p := &pipeline{}
+	for i, u := range urls {
+		s := &stage{Name: u, URL: u}
+		if i > 0 {
+			s.Depends = []string{urls[i-1]}
+		}
+		p.Stages = append(p.Stages, s)
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Parses a JSON description of a pipeline.
+func parsePipeline(data []byte) (*pipeline, error) {
+	p := &pipeline{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// The manager accepts either a single JSON pipeline description or a
+// list of urls (which are run in order). Anything else is discarded.
+func parseArgs(args []string) (*pipeline, error) {
+	if len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return parsePipeline([]byte(args[0]))
+	}
+
+	// sanitize args to make sure they contain valid urls
+	urls := []string{}
+	for _, arg := range args {
+		parsedUrl, err := url.Parse(arg)
+		if err == nil && (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") {
+			urls = append(urls, arg)
+		} else {
+			log.Printf("'%v' is not a valid url, discarding", arg)
+		}
+	}
+	return newChainPipeline(urls)
+}
+
+// The stage named `name`, or nil if there isn't one.
+func (p *pipeline) stage(name string) *stage {
+	for _, s := range p.Stages {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// True if the stage's policy is to skip records that are missing a
+// required input, and `record` is one of them. Records that aren't JSON
+// objects are sent to the bundle, so it can complain about them.
+func (s *stage) skips(record []byte) bool {
+	if s.Policy.OnMissingInputs != "skip" {
+		return false
+	}
+	f := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(record, &f); err != nil {
+		return false
+	}
+	optional := make(map[string]bool)
+	for _, name := range s.Optional {
+		optional[name] = true
+	}
+	for _, name := range s.Inputs {
+		if _, ok := f[name]; !ok && !optional[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the given JSON records into a single record. Fields in later
+// records overwrite fields in earlier ones. A single record is returned
+// untouched.
+func mergeRecords(records [][]byte) ([]byte, error) {
+	if len(records) == 1 {
+		return records[0], nil
+	}
+
+	merged := make(map[string]interface{})
+	for _, record := range records {
+		fields := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(record))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, err
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// Sends the record through the pipeline. Each stage is run as soon as
+// all of its dependencies have finished, so independent stages run
+// concurrently. A stage with several dependencies receives the merge
+// of their outputs; likewise, the result is the merge of the outputs of
+// every stage that nothing else depends on. Records that fail are kept
+// in the dead letter store, if there is one, unless they're replayed
+// traffic.
+func (p *pipeline) run(record []byte, t *trace) ([]byte, error) {
+	start := time.Now()
+	output, fieldLineage, err := p.runStages(record, t)
+	if err == nil && fieldLineage != nil {
+		output, err = addLineage(output, fieldLineage, t)
+	}
+	if err == nil && int64(len(output)) > p.Limits.Response {
+		output, err = nil, tooLarge("the response", p.Limits.Response)
+	}
+	p.metrics.observe(time.Since(start), err)
+	p.logRecord(t, time.Since(start), err)
+	// `plumber replay` runs recorded traffic against candidate bundles,
+	// so its failures are neither dead letters nor traffic to record
+	if err != nil && p.deadLetters != nil && !t.isReplay() {
+		if id, dlqErr := p.deadLetters.add(p.Name, record, err); dlqErr != nil {
+			logEvent(logFields{Pipeline: p.Name, RequestID: t.requestID(), Err: dlqErr}, "Could not store dead letter: %v", dlqErr)
+		} else {
+			t.storedAs(id)
+		}
+	}
+	if p.recorder != nil && !t.isReplay() {
+		if recErr := p.recorder.add(p.Name, t.requestID(), record, output, err); recErr != nil {
+			logEvent(logFields{Pipeline: p.Name, RequestID: t.requestID(), Err: recErr}, "Could not record traffic: %v", recErr)
+		}
+	}
+	return output, err
+}
+
+// Also works out where each field of the result came from, if the
+// pipeline keeps track of lineage.
+func (p *pipeline) runStages(record []byte, t *trace) ([]byte, lineage, error) {
+	var recordLineage lineage
+	var lineages []lineage
+	if p.Lineage {
+		recordLineage = traceFields(record, nil, inputSource)
+		lineages = make([]lineage, len(p.order))
+	}
+	if len(p.order) == 0 {
+		return record, recordLineage, nil
+	}
+
+	outputs := make([][]byte, len(p.order))
+	errs := make([]error, len(p.order))
+	done := make([]chan struct{}, len(p.order))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	for i, s := range p.order {
+		go func(i int, s *stage) {
+			defer close(done[i])
+
+			inputs := [][]byte{record}
+			if len(s.parents) > 0 {
+				inputs = make([][]byte, 0, len(s.parents))
+				for _, j := range s.parents {
+					<-done[j]
+					if errs[j] != nil {
+						errs[i] = errs[j]
+						return
+					}
+					inputs = append(inputs, outputs[j])
+				}
+			}
+			if lineages != nil {
+				defer func() {
+					if errs[i] != nil {
+						return
+					}
+					sources := []tracedRecord{{record, recordLineage}}
+					if len(s.parents) > 0 {
+						sources = tracedOutputs(s.parents, outputs, lineages)
+					}
+					lineages[i] = traceFields(outputs[i], sources, &fieldSource{Bundle: s.Name, Image: s.Image})
+				}()
+			}
+
+			var input []byte
+			var err error
+			if p.Merge != nil && len(s.parents) > 0 {
+				input, err = p.mergeOutputs(s.parents, outputs)
+			} else if input, err = mergeRecords(inputs); err != nil {
+				err = &stageError{s.Name, http.StatusBadGateway, fmt.Errorf("could not merge inputs: %v", err), nil}
+			}
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			start := time.Now()
+			skipped := s.skips(input)
+			defer taps.publish(p.Name, s.Name, func() *tapEvent {
+				e := &tapEvent{
+					ID:      t.requestID(),
+					Bundle:  s.Name,
+					Time:    start,
+					Elapsed: float64(time.Since(start)) / float64(time.Millisecond),
+					Skipped: skipped,
+					Input:   rawRecord(input),
+					Output:  rawRecord(outputs[i]),
+				}
+				if errs[i] != nil {
+					e.Error = errs[i].Error()
+				}
+				return e
+			})
+			if skipped {
+				outputs[i] = input
+				s.metrics.skipped()
+				t.skip(s.Name)
+				return
+			}
+			sent := input
+			if p.Merge != nil && p.Merge.Project {
+				if sent, errs[i] = project(s, input); errs[i] != nil {
+					return
+				}
+			}
+			outputs[i], errs[i] = s.call(sent, t)
+			if s.shadow != nil {
+				s.shadow.mirror(t.requestID(), sent, outputs[i], errs[i])
+			}
+			if errs[i] == nil && p.Merge != nil {
+				outputs[i], errs[i] = p.Merge.apply(s, input, outputs[i])
+			}
+		}(i, s)
+	}
+
+	results := [][]byte{}
+	sinks := []int{}
+	for i, s := range p.order {
+		<-done[i]
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		if s.sink {
+			results = append(results, outputs[i])
+			sinks = append(sinks, i)
+		}
+	}
+	var output []byte
+	var err error
+	if p.Merge != nil {
+		output, err = p.mergeOutputs(sinks, outputs)
+	} else {
+		output, err = mergeRecords(results)
+	}
+	if err != nil || lineages == nil {
+		return output, nil, err
+	}
+	return output, traceFields(output, tracedOutputs(sinks, outputs, lineages), nil), nil
+}
@@ -0,0 +1,278 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an enhancer that sleeps for a bit and then adds `field` to the JSON
+// it was sent
+func makeEnhancer(field string, delay time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		record := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		record[field] = fmt.Sprintf("%s saw %d fields", field, len(record))
+		json.NewEncoder(w).Encode(record)
+	}
+}
+
+func TestParsePipelineSortsStages(t *testing.T) {
+	p, err := parsePipeline([]byte(`{"name": "foo", "stages": [
+		{"name": "c", "url": "http://c", "depends": ["a", "b"]},
+		{"name": "b", "url": "http://b"},
+		{"name": "a", "url": "http://a"}]}`))
+	if err != nil {
+		t.Fatalf("ParsePipeline: got unexpected error '%v'", err)
+	}
+
+	names := []string{}
+	for _, s := range p.order {
+		names = append(names, s.Name)
+	}
+	if fmt.Sprint(names) != "[b a c]" {
+		t.Errorf("ParsePipeline: got order '%v'", names)
+	}
+	if !p.Stages[0].sink || p.Stages[1].sink || p.Stages[2].sink {
+		t.Error("ParsePipeline: only 'c' should be a sink")
+	}
+}
+
+func TestParsePipelineErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"stages": [{"name": "a", "url": "http://a", "depends": ["b"]}]}`:                                                                  "Stage 'a' depends on unknown stage 'b'.",
+		`{"stages": [{"name": "a", "url": "http://a"}, {"name": "a", "url": "http://b"}]}`:                                                  "Stage 'a' is declared more than once.",
+		`{"stages": [{"name": "a", "url": "ftp://a"}]}`:                                                                                     "Stage 'a' does not have a valid url: 'ftp://a'.",
+		`{"stages": [{"name": "a", "urls": ["http://a", "ftp://b"]}]}`:                                                                      "Stage 'a' does not have a valid url: 'ftp://b'.",
+		`{"stages": [{"name": "a", "url": "http://a", "urls": ["http://b"]}]}`:                                                              "Stage 'a' has both a 'url' and 'urls'.",
+		`{"stages": [{"name": "a"}]}`:                                                                                                       "Stage 'a' does not have a 'url'.",
+		`{"stages": [{"url": "http://a"}]}`:                                                                                                 "Stage 0 is missing a 'name'.",
+		`{"name": "x", "stages": [{"name": "a", "url": "http://a", "depends": ["b"]}, {"name": "b", "url": "http://b", "depends": ["a"]}]}`: "Pipeline 'x' is not a DAG!",
+	}
+	for config, expected := range cases {
+		_, err := parsePipeline([]byte(config))
+		if err == nil || err.Error() != expected {
+			t.Errorf("ParsePipeline: expected '%s', got '%v'", expected, err)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	p, err := parseArgs([]string{"http://a", "-test.v", "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.order) != 2 || p.order[1].Depends[0] != "http://a" {
+		t.Errorf("ParseArgs: did not build a chain from urls, got '%v'", p.order)
+	}
+
+	p, err = parseArgs([]string{`{"stages": [{"name": "a", "url": "http://a"}]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.order) != 1 || p.order[0].Name != "a" {
+		t.Errorf("ParseArgs: did not parse JSON pipeline, got '%v'", p.order)
+	}
+}
+
+// Test that a record fans out to independent stages, which run
+// concurrently, and that their outputs are merged before a dependent
+// stage runs.
+func TestPipelineRunsDAG(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	a := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", delay)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeEnhancer("b", delay)))
+	defer b.Close()
+	c := httptest.NewServer(http.HandlerFunc(makeEnhancer("c", 0)))
+	defer c.Close()
+	d := httptest.NewServer(http.HandlerFunc(makeEnhancer("d", delay)))
+	defer d.Close()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"stages": [
+		{"name": "a", "url": "%s"},
+		{"name": "b", "url": "%s"},
+		{"name": "c", "url": "%s", "depends": ["a", "b"]},
+		{"name": "d", "url": "%s"}]}`, a.URL, b.URL, c.URL, d.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	result, err := p.run([]byte(`{"x": 1}`), nil)
+	if err != nil {
+		t.Fatalf("PipelineRunsDAG: got unexpected error '%v'", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*delay {
+		t.Errorf("PipelineRunsDAG: stages did not run concurrently, took %v", elapsed)
+	}
+
+	record := make(map[string]interface{})
+	if err := json.Unmarshal(result, &record); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"x": 1.0,
+		"a": "a saw 1 fields",
+		"b": "b saw 1 fields",
+		"c": "c saw 3 fields",
+		"d": "d saw 1 fields",
+	}
+	if fmt.Sprint(record) != fmt.Sprint(expected) {
+		t.Errorf("PipelineRunsDAG: got '%v'", record)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	merged, err := mergeRecords([][]byte{[]byte(`{"a": 1, "b": 2}`), []byte(`{"b": 3, "c": 12345678901234567890}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(merged) != `{"a":1,"b":3,"c":12345678901234567890}` {
+		t.Errorf("MergeRecords: got '%s'", merged)
+	}
+
+	if _, err := mergeRecords([][]byte{[]byte(`{}`), []byte(`[1, 2]`)}); err == nil {
+		t.Error("MergeRecords: expected an error merging a non-object")
+	}
+}
+
+func TestPipelineSkipsMissingInputs(t *testing.T) {
+	var calls int32
+	hello := makeCountingEnhancer(&calls)
+	defer hello.Close()
+	after := httptest.NewServer(http.HandlerFunc(makeEnhancer("after", 0)))
+	defer after.Close()
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "skip", "stages": [
+		{"name": "hello", "url": "%s", "inputs": ["name", "title"], "optional": ["title"],
+		 "policy": {"onMissingInputs": "skip"}},
+		{"name": "after", "url": "%s", "depends": ["hello"]}]}`, hello.URL, after.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createHandler(p)
+	// the registry outlives the test, so only count what this run adds
+	m := registry.stage("skip", "hello")
+	m.Lock()
+	skips := m.skips
+	m.Unlock()
+
+	post := func(record string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(record))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// a missing optional input doesn't skip the stage
+	w := post(`{"name": "a"}`)
+	if w.Code != http.StatusOK || w.Header().Get(skippedHeader) != "" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("stage was skipped: %d '%s'", w.Code, w.Body.String())
+	}
+
+	// a missing required input passes the record on untouched
+	w = post(`{"title": "dr"}`)
+	if w.Code != http.StatusOK || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("stage was not skipped: %d '%s'", w.Code, w.Body.String())
+	}
+	if w.Body.String() != `{"after":"after saw 1 fields","title":"dr"}`+"\n" {
+		t.Errorf("unexpected response '%s'", w.Body.String())
+	}
+	if w.Header().Get(skippedHeader) != "hello" {
+		t.Errorf("expected 'hello' to be skipped, got '%s'", w.Header().Get(skippedHeader))
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.skips-skips != 1 {
+		t.Errorf("expected 1 skip, got %d", m.skips-skips)
+	}
+}
+
+// Results in a batch or stream don't have headers, so they say which
+// stages they skipped themselves.
+func TestPipelineSkipsInBatches(t *testing.T) {
+	var calls int32
+	hello := makeCountingEnhancer(&calls)
+	defer hello.Close()
+	after := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "fail") {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}))
+	defer after.Close()
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "skip-batch", "lineage": true, "stages": [
+		{"name": "hello", "url": "%s", "inputs": ["name"], "policy": {"onMissingInputs": "skip"}},
+		{"name": "after", "url": "%s", "depends": ["hello"]}]}`, hello.URL, after.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		Lineage struct {
+			Skipped []string `json:"skipped"`
+		} `json:"_plumber"`
+		Error   *errorDetails `json:"error"`
+		Skipped []string      `json:"skipped"`
+	}
+	for path, handler := range map[string]http.HandlerFunc{
+		"/batch":  createBatchHandler(p),
+		"/stream": createStreamHandler(p),
+	} {
+		body := `[{"title": "dr"}, {"fail": true}]`
+		if path == "/stream" {
+			body = "{\"title\": \"dr\"}\n{\"fail\": true}\n"
+		}
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		results := []result{}
+		if path == "/batch" {
+			err = json.Unmarshal(w.Body.Bytes(), &results)
+		} else {
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				var r result
+				err = json.Unmarshal([]byte(line), &r)
+				results = append(results, r)
+			}
+		}
+		if err != nil || len(results) != 2 {
+			t.Fatalf("%s: unexpected response '%s'", path, w.Body.String())
+		}
+		if fmt.Sprint(results[0].Lineage.Skipped) != "[hello]" {
+			t.Errorf("%s: expected the record to say it skipped 'hello', got '%s'", path, w.Body.String())
+		}
+		if results[1].Error == nil || fmt.Sprint(results[1].Skipped) != "[hello]" {
+			t.Errorf("%s: expected the error to say it skipped 'hello', got '%s'", path, w.Body.String())
+		}
+	}
+}
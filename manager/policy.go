@@ -0,0 +1,207 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The default delay before the first retry; it doubles on every retry.
+const defaultBackoff = 100 * time.Millisecond
+
+// How the manager talks to a stage. Durations are strings understood
+// by time.ParseDuration. A zero policy means no timeout, no retries and
+// no circuit breaker.
+type policy struct {
+	Timeout    string         `json:"timeout,omitempty"`
+	Retries    int            `json:"retries,omitempty"` // only used if Idempotent
+	Backoff    string         `json:"backoff,omitempty"`
+	Idempotent bool           `json:"idempotent,omitempty"`
+	Breaker    *breakerPolicy `json:"breaker,omitempty"`
+	// "skip" passes records that are missing a required input through
+	// unchanged instead of sending them to the bundle
+	OnMissingInputs string `json:"onMissingInputs,omitempty"`
+
+	timeout time.Duration
+	backoff time.Duration
+}
+
+// The circuit breaker opens after `Failures` consecutive failures and
+// lets a single request through once `Cooldown` has passed.
+type breakerPolicy struct {
+	Failures int    `json:"failures,omitempty"`
+	Cooldown string `json:"cooldown,omitempty"`
+
+	cooldown time.Duration
+}
+
+func parseDuration(name, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("'%s' is not a valid %s.", value, name)
+	}
+	return d, nil
+}
+
+func (p *policy) init() error {
+	var err error
+	if p.timeout, err = parseDuration("timeout", p.Timeout, 0); err != nil {
+		return err
+	}
+	if p.backoff, err = parseDuration("backoff", p.Backoff, defaultBackoff); err != nil {
+		return err
+	}
+	if p.Retries < 0 {
+		return fmt.Errorf("'%d' is not a valid number of retries.", p.Retries)
+	}
+	if p.OnMissingInputs != "" && p.OnMissingInputs != "fail" && p.OnMissingInputs != "skip" {
+		return fmt.Errorf("'onMissingInputs' must be 'fail' or 'skip', not '%s'.", p.OnMissingInputs)
+	}
+	if p.Breaker != nil {
+		if p.Breaker.cooldown, err = parseDuration("cooldown", p.Breaker.Cooldown, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number of times a request is attempted.
+func (p *policy) attempts() int {
+	if p.Idempotent {
+		return p.Retries + 1
+	}
+	return 1
+}
+
+// A circuit breaker for a single stage. It is shared by every request
+// going through the stage.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int       // consecutive failures
+	openUntil time.Time // when we will next let a request through
+	probing   bool      // true while the single trial request is out
+}
+
+func newBreaker(p *breakerPolicy) *breaker {
+	if p == nil || p.Failures <= 0 {
+		return nil
+	}
+	return &breaker{threshold: p.Failures, cooldown: p.cooldown}
+}
+
+// Returns nil if a request may be sent to the stage, or an error that
+// says how long until the breaker lets one through. A nil breaker
+// always allows requests.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		// while the trial request is out, we can't tell when the next
+		// one goes through, so callers try again soon
+		return &overloadError{http.StatusServiceUnavailable, "circuit breaker is open; not sending request", b.openUntil.Sub(time.Now())}
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// Sends the record to the stage according to the stage's policy,
+// retrying with exponential backoff if the stage is idempotent. Only
+// connection errors, timeouts and 5xx responses are retried.
+func (s *stage) call(record []byte, t *trace) ([]byte, error) {
+	defer func(start time.Time) {
+		t.observe(s.Name, time.Since(start))
+	}(time.Now())
+
+	if int64(len(record)) > s.Limits.Request {
+		// the record is too big to be worth echoing back
+		return nil, newStageError(s, &sizeError{"the record sent to the bundle", s.Limits.Request}, nil)
+	}
+
+	key, output, cacheable := s.cached(record)
+	if output != nil {
+		return output, nil
+	}
+
+	var err error
+	backoff := s.Policy.backoff
+	for attempt := 0; attempt < s.Policy.attempts(); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		// a record that's turned away by the limiter must not take the
+		// breaker's trial request with it, so it has to be admitted first
+		if err := s.limiter.acquire(); err != nil {
+			return nil, newStageError(s, err, record)
+		}
+		if err := s.breaker.allow(); err != nil {
+			s.limiter.release()
+			return nil, newStageError(s, err, record)
+		}
+		var output []byte
+		s.metrics.begin(len(record))
+		start := time.Now()
+		e := s.balancer.pick()
+		output, err = forwardData(s.client, e.url, record, t.requestID(), s.Limits.Response)
+		s.balancer.done(e, err)
+		s.metrics.end(time.Since(start), len(output), err)
+		s.limiter.release()
+		if !retryable(err) {
+			// the enhancer is up, even if it didn't like the record
+			s.breaker.record(nil)
+			if err == nil {
+				if cacheable {
+					s.store(key, output)
+				}
+				return output, nil
+			}
+			break
+		}
+		s.breaker.record(err)
+	}
+	return nil, newStageError(s, err, record)
+}
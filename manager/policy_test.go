@@ -0,0 +1,161 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an enhancer that drops the connection for the first `failures`
+// requests and echoes afterwards; `calls` counts the requests made
+func makeFlakyEnhancer(failures int32, calls *int32) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		w.Write(buf.Bytes())
+	}
+}
+
+func TestPolicyTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 200*time.Millisecond)))
+	defer ts.Close()
+
+	p := newTestPipeline(t, withStages(`{"name": "a", "url": %q, "policy": {"timeout": "50ms"}}`, ts.URL))
+	w := post(createHandler(p), "/", `{"foo": 3}`)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("PolicyTimeout: expected a 504, got %d", w.Code)
+	}
+}
+
+func TestPolicyRetriesIdempotentStages(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(makeFlakyEnhancer(2, &calls)))
+	defer ts.Close()
+
+	p := newTestPipeline(t, withStages(`{"name": "a", "url": %q, "policy": {"retries": 2, "backoff": "1ms", "idempotent": true}}`, ts.URL))
+	w := post(createHandler(p), "/", `{"foo": 3}`)
+	if n := atomic.LoadInt32(&calls); w.Code != 200 || w.Body.String() != `{"foo": 3}` || n != 3 {
+		t.Errorf("PolicyRetries: got %d '%s' after %d calls", w.Code, w.Body.String(), n)
+	}
+
+	// stages that aren't idempotent are never retried
+	atomic.StoreInt32(&calls, 0)
+	p = newTestPipeline(t, withStages(`{"name": "a", "url": %q, "policy": {"retries": 2, "backoff": "1ms"}}`, ts.URL))
+	w = post(createHandler(p), "/", `{"foo": 3}`)
+	if n := atomic.LoadInt32(&calls); w.Code != http.StatusBadGateway || n != 1 {
+		t.Errorf("PolicyRetries: got %d after %d calls", w.Code, n)
+	}
+}
+
+func TestPolicyCircuitBreaker(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(makeFlakyEnhancer(2, &calls)))
+	defer ts.Close()
+
+	p := newTestPipeline(t, withStages(`{"name": "a", "url": %q, "policy": {"breaker": {"failures": 2, "cooldown": "100ms"}}}`, ts.URL))
+	for i := 0; i < 2; i++ {
+		if w := post(createHandler(p), "/", `{"foo": 3}`); w.Code != http.StatusBadGateway {
+			t.Errorf("PolicyCircuitBreaker: expected a 502, got %d", w.Code)
+		}
+	}
+
+	// the breaker is open, so we fail without calling the enhancer
+	w := post(createHandler(p), "/", `{"foo": 3}`)
+	if n := atomic.LoadInt32(&calls); w.Code != http.StatusServiceUnavailable || n != 2 {
+		t.Errorf("PolicyCircuitBreaker: got %d after %d calls", w.Code, n)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("PolicyCircuitBreaker: expected to be told to retry after 1s, got '%s'", retry)
+	}
+
+	// after the cooldown a request is let through, which closes it
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if w := post(createHandler(p), "/", `{"foo": 3}`); w.Code != 200 {
+			t.Errorf("PolicyCircuitBreaker: expected a 200, got %d", w.Code)
+		}
+	}
+}
+
+// The breaker says how long until it lets a request through again.
+func TestPolicyCircuitBreakerRetryAfter(t *testing.T) {
+	b := newBreaker(&breakerPolicy{Failures: 1, cooldown: 3 * time.Second})
+	b.record(fmt.Errorf("oops"))
+	err, ok := b.allow().(*overloadError)
+	if !ok || err.status != http.StatusServiceUnavailable || err.retryAfterSeconds() != "3" {
+		t.Errorf("PolicyCircuitBreakerRetryAfter: got '%v'", b.allow())
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	_, err := parsePipeline([]byte(`{"stages": [{"name": "a", "url": "http://a", "policy": {"timeout": "soon"}}]}`))
+	if err == nil || err.Error() != "Stage 'a' has an invalid policy: 'soon' is not a valid timeout." {
+		t.Errorf("PolicyInvalid: got unexpected error '%v'", err)
+	}
+
+	_, err = parsePipeline([]byte(`{"stages": [{"name": "a", "url": "http://a", "policy": {"onMissingInputs": "ignore"}}]}`))
+	if err == nil {
+		t.Error("PolicyInvalid: expected an error for 'onMissingInputs'")
+	}
+}
+
+// A record that is turned away by the stage's limiter while the breaker
+// is half open mustn't keep the breaker open for good.
+func TestPolicyCircuitBreakerRecoversFromOverload(t *testing.T) {
+	for _, path := range []string{"/", "/pipe"} {
+		var calls int32
+		ts := httptest.NewServer(http.HandlerFunc(makeFlakyEnhancer(2, &calls)))
+		p := newTestPipeline(t, withStages(`{"name": "a", "url": %q,
+			"policy": {"breaker": {"failures": 2, "cooldown": "50ms"}},
+			"admission": {"maxInFlight": 1}}`, ts.URL))
+		handler := createHandler(p)
+		if path == "/pipe" {
+			handler = createPipeHandler(p)
+		}
+		for i := 0; i < 2; i++ {
+			post(handler, path, `{"foo": 3}`)
+		}
+
+		// the stage is saturated when the breaker lets its trial through
+		time.Sleep(100 * time.Millisecond)
+		s := p.stage("a")
+		if err := s.limiter.acquire(); err != nil {
+			t.Fatal(err)
+		}
+		if code := post(handler, path, `{"foo": 3}`).Code; code != http.StatusServiceUnavailable {
+			t.Errorf("PolicyCircuitBreakerRecoversFromOverload %s: expected a 503, got %d", path, code)
+		}
+		s.limiter.release()
+
+		if code := post(handler, path, `{"foo": 3}`).Code; code != 200 {
+			t.Errorf("PolicyCircuitBreakerRecoversFromOverload %s: the stage did not recover; got %d", path, code)
+		}
+		ts.Close()
+	}
+}
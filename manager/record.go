@@ -0,0 +1,119 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Recorded traffic is appended to this file in the recording's `dir`,
+// one JSON object per line. `plumber replay` reads the same file.
+const recordingFile = "recording.jsonl"
+
+// Requests with this header are replays of recorded traffic, so they
+// aren't recorded again. It's ignored unless the pipeline trusts the
+// caller with it.
+const replayHeader = "X-Plumber-Replay"
+
+// Records a sample of the records sent to the pipeline, along with the
+// responses we gave, so changes to bundles can be tested against real
+// traffic.
+type recordPolicy struct {
+	Dir    string  `json:"dir"`
+	Sample float64 `json:"sample,omitempty"` // the fraction of records to keep; all of them if 0
+}
+
+func (r *recordPolicy) init() error {
+	if r.Dir == "" {
+		return fmt.Errorf("The recording needs a 'dir'.")
+	}
+	if r.Sample < 0 || r.Sample > 1 {
+		return fmt.Errorf("The recording's 'sample' must be between 0 and 1.")
+	}
+	if r.Sample == 0 {
+		r.Sample = 1
+	}
+	return nil
+}
+
+// A record sent to the pipeline and the response we gave.
+type recording struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Pipeline string          `json:"pipeline,omitempty"`
+	Record   json.RawMessage `json:"record"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type recorder struct {
+	sync.Mutex
+	path   string
+	sample float64
+}
+
+func newRecorder(policy *recordPolicy) (*recorder, error) {
+	if err := os.MkdirAll(policy.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recorder{path: filepath.Join(policy.Dir, recordingFile), sample: policy.Sample}, nil
+}
+
+// Appends the record and its response (or error) to the recording, if
+// it's sampled. Like dead letters, we open the file for every write so
+// it can be moved out from under us.
+func (r *recorder) add(pipeline, id string, record, output []byte, err error) error {
+	if r.sample < 1 && rand.Float64() >= r.sample {
+		return nil
+	}
+	entry := recording{
+		ID:       id,
+		Time:     time.Now().UTC(),
+		Pipeline: pipeline,
+		Record:   rawRecord(record),
+		Status:   http.StatusOK,
+		Response: rawRecord(output),
+	}
+	if err != nil {
+		var details errorDetails
+		entry.Status, details = describeError(err)
+		entry.Error = details.Message
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
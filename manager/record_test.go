@@ -0,0 +1,94 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecording(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plumberTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ts := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer ts.Close()
+	dir := filepath.Join(tempDir, "recordings")
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "rec", "record": {"dir": "%s"}, "stages": [
+		{"name": "a", "url": "%s"}]}`, dir, ts.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createHandler(p)
+	post := func(record string, replay bool) {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(record))
+		req.Header.Set(requestIDHeader, "rec-id")
+		if replay {
+			req.Header.Set(replayHeader, "1")
+		}
+		handler(httptest.NewRecorder(), req)
+	}
+	post(`{"x": 1}`, false)
+	post(`nope`, false)
+	// replays aren't recorded again
+	post(`{"x": 2}`, true)
+
+	file, err := os.Open(filepath.Join(dir, recordingFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	recordings := []recording{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r recording
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		recordings = append(recordings, r)
+	}
+
+	if len(recordings) != 2 {
+		t.Fatalf("Recording: got '%v'", recordings)
+	}
+	if r := recordings[0]; r.ID != "rec-id" || r.Pipeline != "rec" || r.Status != http.StatusOK ||
+		string(r.Record) != `{"x":1}` || string(r.Response) != `{"a":"a saw 1 fields","x":1}` || r.Error != "" {
+		t.Errorf("Recording: got '%v'", r)
+	}
+	if r := recordings[1]; r.Status != http.StatusUnprocessableEntity || string(r.Record) != `"nope"` ||
+		r.Response != nil || r.Error == "" {
+		t.Errorf("Recording: got '%v' for a failed record", r)
+	}
+}
+
+func TestRecordPolicyInvalid(t *testing.T) {
+	for _, record := range []string{`{}`, `{"dir": "/tmp", "sample": 2}`} {
+		if _, err := parsePipeline([]byte(fmt.Sprintf(`{"record": %s, "stages": []}`, record))); err == nil {
+			t.Errorf("expected an error for recording '%s'", record)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shadow results are appended to this file in the pipeline's
+// `shadowDir`, one JSON object per line. `plumber shadow report` reads
+// the same file.
+const shadowFile = "shadow.jsonl"
+
+// How many mirrored records can be waiting on a candidate at once.
+// Beyond that, records aren't mirrored, so a slow candidate can't pile
+// up goroutines.
+const maxShadowInFlight = 16
+
+// Mirrors a `Sample` of the records sent to a stage to a candidate
+// version of its bundle at `URL`. The candidate's output is compared
+// with the stage's and thrown away; callers only ever see the stage's.
+type shadowPolicy struct {
+	URL    string  `json:"url"`
+	Sample float64 `json:"sample,omitempty"` // the fraction of records to mirror; all of them if 0
+}
+
+func (s *shadowPolicy) init() error {
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("The shadow does not have a valid url: '%s'.", s.URL)
+	}
+	if s.Sample < 0 || s.Sample > 1 {
+		return fmt.Errorf("The shadow's 'sample' must be between 0 and 1.")
+	}
+	if s.Sample == 0 {
+		s.Sample = 1
+	}
+	return nil
+}
+
+// How the candidate's output for a record differed from the stage's.
+// Fields are top-level fields of the output.
+type shadowResult struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	Pipeline       string    `json:"pipeline,omitempty"`
+	Bundle         string    `json:"bundle"`
+	Candidate      string    `json:"candidate"`
+	Match          bool      `json:"match"`
+	Added          []string  `json:"added,omitempty"`   // fields only the candidate output
+	Removed        []string  `json:"removed,omitempty"` // fields only the stage output
+	Changed        []string  `json:"changed,omitempty"` // fields with different values
+	Error          string    `json:"error,omitempty"`   // the stage's error
+	CandidateError string    `json:"candidateError,omitempty"`
+	Elapsed        float64   `json:"elapsed"` // how long the candidate took, in milliseconds
+}
+
+// Compares two outputs field by field. Outputs that aren't JSON objects
+// are compared as a whole.
+func diffOutputs(primary, candidate []byte) (added, removed, changed []string, match bool) {
+	p, err := decodeFields(primary)
+	c, candidateErr := decodeFields(candidate)
+	if err != nil || candidateErr != nil {
+		match = sameValue(primary, candidate)
+		return
+	}
+	for field, value := range c {
+		if old, ok := p[field]; !ok {
+			added = append(added, field)
+		} else if !sameValue(old, value) {
+			changed = append(changed, field)
+		}
+	}
+	for field := range p {
+		if _, ok := c[field]; !ok {
+			removed = append(removed, field)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	match = len(added) == 0 && len(removed) == 0 && len(changed) == 0
+	return
+}
+
+// True if `a` and `b` are the same JSON value, however they're
+// formatted and whatever order their keys are in. Values that aren't
+// valid JSON are compared byte for byte.
+func sameValue(a, b []byte) bool {
+	aValue, aErr := decodeValue(a)
+	bValue, bErr := decodeValue(b)
+	if aErr != nil || bErr != nil {
+		return bytes.Equal(bytes.TrimSpace(a), bytes.TrimSpace(b))
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// Numbers are kept as they were written, so 1 and 1.0 still differ
+// and large integers aren't rounded.
+func decodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+// Appends shadow results to the pipeline's shadow file. Like dead
+// letters, we open the file for every write so it can be moved out
+// from under us.
+type shadowStore struct {
+	sync.Mutex
+	path string
+}
+
+func newShadowStore(dir string) (*shadowStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &shadowStore{path: filepath.Join(dir, shadowFile)}, nil
+}
+
+func (s *shadowStore) add(result *shadowResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// A stage's candidate.
+type shadow struct {
+	policy   shadowPolicy
+	pipeline string
+	stage    *stage
+	client   *http.Client
+	store    *shadowStore // nil if the pipeline has no `shadowDir`
+	slots    chan struct{}
+}
+
+func newShadow(p *pipeline, s *stage) *shadow {
+	return &shadow{
+		policy:   *s.Shadow,
+		pipeline: p.Name,
+		stage:    s,
+		client:   &http.Client{Timeout: s.Policy.timeout, Transport: p.transport},
+		store:    p.shadows,
+		slots:    make(chan struct{}, maxShadowInFlight),
+	}
+}
+
+// Sends a sample of records to the candidate in the background, along
+// with what the stage made of them. Never blocks the record.
+func (sh *shadow) mirror(id string, record, output []byte, err error) {
+	if sh.policy.Sample < 1 && rand.Float64() >= sh.policy.Sample {
+		return
+	}
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-sh.slots }()
+		sh.compare(id, record, output, err)
+	}()
+}
+
+func (sh *shadow) compare(id string, record, output []byte, err error) *shadowResult {
+	start := time.Now()
+	candidate, candidateErr := forwardData(sh.client, sh.policy.URL, record, id, sh.stage.Limits.Response)
+	result := &shadowResult{
+		ID:        id,
+		Time:      start.UTC(),
+		Pipeline:  sh.pipeline,
+		Bundle:    sh.stage.Name,
+		Candidate: sh.policy.URL,
+		Elapsed:   float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		_, details := describeError(err)
+		result.Error = details.Message
+	}
+	if candidateErr != nil {
+		result.CandidateError = candidateErr.Error()
+	}
+	switch {
+	case err != nil || candidateErr != nil:
+		// they only match if they both failed
+		result.Match = err != nil && candidateErr != nil
+	default:
+		result.Added, result.Removed, result.Changed, result.Match = diffOutputs(output, candidate)
+	}
+	sh.stage.metrics.shadowed(result)
+	if sh.store != nil {
+		if err := sh.store.add(result); err != nil {
+			logEvent(logFields{Pipeline: sh.pipeline, Bundle: sh.stage.Name, RequestID: id, Err: err}, "Could not store shadow result for '%s': %v", sh.stage.Name, err)
+		}
+	}
+	return result
+}
@@ -0,0 +1,136 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for `n` shadow results to show up in `dir`.
+func readShadowResults(t *testing.T, dir string, n int) []shadowResult {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, shadowFile))
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(data) > 0 && len(lines) >= n {
+			results := make([]shadowResult, len(lines))
+			for i, line := range lines {
+				if err := json.Unmarshal([]byte(line), &results[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return results
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("never got %d shadow results", n)
+	return nil
+}
+
+func TestShadow(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer primary.Close()
+	candidateCalls := make(chan string, 1)
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		candidateCalls <- r.Header.Get(requestIDHeader)
+		w.Write([]byte(`{"x": 1, "a": "something else", "b": true}`))
+	}))
+	defer candidate.Close()
+	dir := t.TempDir()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "shadow", "shadowDir": "%s", "stages": [
+		{"name": "a", "url": "%s", "shadow": {"url": "%s"}}]}`, dir, primary.URL, candidate.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := p.run([]byte(`{"x": 1}`), newTrace("shadowed"))
+	if err != nil || !bytes.Contains(output, []byte(`"a saw 1 fields"`)) {
+		t.Fatalf("the caller got '%s', %v", output, err)
+	}
+	if id := <-candidateCalls; id != "shadowed" {
+		t.Errorf("the candidate got request id '%s'", id)
+	}
+
+	results := readShadowResults(t, dir, 1)
+	r := results[0]
+	if r.ID != "shadowed" || r.Bundle != "a" || r.Candidate != candidate.URL || r.Match ||
+		fmt.Sprint(r.Added) != "[b]" || fmt.Sprint(r.Changed) != "[a]" || len(r.Removed) != 0 {
+		t.Errorf("unexpected shadow result %+v", r)
+	}
+}
+
+func TestShadowCandidateFails(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer primary.Close()
+	candidate := makeFixedEnhancer("")
+	candidate.Close()
+	dir := t.TempDir()
+
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "shadow-fails", "shadowDir": "%s", "stages": [
+		{"name": "a", "url": "%s", "shadow": {"url": "%s", "sample": 1}}]}`, dir, primary.URL, candidate.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the candidate being down doesn't matter to the caller
+	if _, err := p.run([]byte(`{"x": 1}`), newTrace("")); err != nil {
+		t.Fatal(err)
+	}
+	if r := readShadowResults(t, dir, 1)[0]; r.Match || r.CandidateError == "" || r.Error != "" {
+		t.Errorf("unexpected shadow result %+v", r)
+	}
+}
+
+func TestShadowDiffOutputs(t *testing.T) {
+	added, removed, changed, match := diffOutputs([]byte(`{"a": 1, "b": [1, 2], "c": 3}`), []byte(`{"a":1,"b":[1,2],"d":4}`))
+	if match || fmt.Sprint(added, removed, changed) != "[d] [c] []" {
+		t.Errorf("got %v %v %v %v", added, removed, changed, match)
+	}
+	if _, _, _, match := diffOutputs([]byte(`"x"`), []byte(`"x"`)); !match {
+		t.Error("identical outputs that aren't objects should match")
+	}
+}
+
+func TestShadowDiffOutputsIgnoresFormatting(t *testing.T) {
+	primary := []byte(`{"a": {"x": 1, "y": [1, {"p": true, "q": null}]}, "b": [ 1, 2 ]}`)
+	candidate := []byte(`{"b":[1,2],"a":{"y":[1,{"q":null,"p":true}],"x":1}}`)
+	if added, removed, changed, match := diffOutputs(primary, candidate); !match {
+		t.Errorf("outputs that only differ in formatting should match, got %v %v %v", added, removed, changed)
+	}
+	if _, _, _, match := diffOutputs([]byte(`[{"x": 1, "y": 2}]`), []byte(`[{"y":2,"x":1}]`)); !match {
+		t.Error("outputs that aren't objects should also be compared by value")
+	}
+	_, _, changed, match := diffOutputs([]byte(`{"a": {"x": 1}}`), []byte(`{"a": {"x": 1.0}}`))
+	if match || fmt.Sprint(changed) != "[a]" {
+		t.Errorf("a nested value that changed should be reported, got %v %v", changed, match)
+	}
+}
+
+func TestShadowInvalid(t *testing.T) {
+	for _, shadow := range []string{`{}`, `{"url": "ftp://nope"}`, `{"url": "http://b:9800", "sample": 2}`} {
+		if _, err := parsePipeline([]byte(`{"stages": [{"name": "a", "url": "http://a:9800", "shadow": ` + shadow + `}]}`)); err == nil {
+			t.Errorf("expected an error for shadow %s", shadow)
+		}
+	}
+}
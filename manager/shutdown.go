@@ -0,0 +1,145 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps track of the requests in flight, so the manager can let them
+// finish when it shuts down.
+type drainer struct {
+	inFlight int64
+	served   int64
+	jobs     int64          // work running in the background, like jobs
+	running  sync.WaitGroup // the same
+	once     sync.Once
+	draining chan struct{} // closed once the manager starts shutting down
+}
+
+func newDrainer() *drainer {
+	return &drainer{draining: make(chan struct{})}
+}
+
+// Counts the requests going through `handler`.
+func (d *drainer) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&d.inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&d.inFlight, -1)
+			atomic.AddInt64(&d.served, 1)
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Runs `work` in the background, outliving the request that started
+// it. The manager waits for it to finish before it shuts down. A nil
+// drainer doesn't wait.
+func (d *drainer) background(work func()) {
+	if d == nil {
+		go work()
+		return
+	}
+	atomic.AddInt64(&d.jobs, 1)
+	d.running.Add(1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&d.jobs, -1)
+			d.running.Done()
+		}()
+		work()
+	}()
+}
+
+// Waits for the work in the background to finish, or for `ctx` to be
+// done; false if it didn't finish. Only call this once nothing can
+// start more work.
+func (d *drainer) waitBackground(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (d *drainer) start() {
+	d.once.Do(func() { close(d.draining) })
+}
+
+// Closed once the manager starts shutting down. A nil drainer never
+// shuts down.
+func (d *drainer) done() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.draining
+}
+
+func (d *drainer) isDraining() bool {
+	select {
+	case <-d.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// What happened while the manager shut down.
+type drainSummary struct {
+	served   int64 // requests finished before we stopped accepting new ones
+	inFlight int64 // requests in flight when we stopped accepting new ones
+	jobs     int64 // jobs running when we stopped accepting new requests
+	dropped  int64 // requests and jobs cut off at the deadline
+	elapsed  time.Duration
+}
+
+// Shuts the server down gracefully. Readiness goes false straight away;
+// after `delay`, so that load balancers notice, the server stops
+// accepting requests and waits up to `timeout` for the ones in flight,
+// and then the jobs in the background, before cutting them off.
+func shutdown(server *http.Server, d *drainer, delay, timeout time.Duration) drainSummary {
+	start := time.Now()
+	d.start()
+	time.Sleep(delay)
+
+	summary := drainSummary{
+		served:   atomic.LoadInt64(&d.served),
+		inFlight: atomic.LoadInt64(&d.inFlight),
+		jobs:     atomic.LoadInt64(&d.jobs),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		// handlers may still start jobs, so we can't wait for them
+		summary.dropped = atomic.LoadInt64(&d.inFlight) + atomic.LoadInt64(&d.jobs)
+		server.Close()
+	} else if !d.waitBackground(ctx) {
+		summary.dropped = atomic.LoadInt64(&d.jobs)
+	}
+	summary.elapsed = time.Since(start)
+	return summary
+}
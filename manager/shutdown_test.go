@@ -0,0 +1,137 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a server whose requests are tracked by `d`, returning its url.
+func startDrainServer(t *testing.T, d *drainer, handler http.HandlerFunc) (*http.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: d.track(handler)}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+// Test that a request in flight finishes before the server shuts down.
+func TestShutdownDrains(t *testing.T) {
+	d := newDrainer()
+	started := make(chan struct{})
+	server, url := startDrainServer(t, d, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	summary := shutdown(server, d, 0, time.Second)
+	if b := <-body; b != "done" {
+		t.Errorf("the request in flight got '%s'", b)
+	}
+	if summary.inFlight != 1 || summary.dropped != 0 || summary.served != 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("the server still accepts requests after shutting down")
+	}
+}
+
+// Test that requests still in flight at the deadline are cut off.
+func TestShutdownDeadline(t *testing.T) {
+	d := newDrainer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server, url := startDrainServer(t, d, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	go http.Get(url)
+	<-started
+
+	start := time.Now()
+	summary := shutdown(server, d, 0, 50*time.Millisecond)
+	if summary.dropped != 1 || time.Since(start) > time.Second {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+// Test that jobs, and their callbacks, finish before the manager shuts
+// down, even though their requests already have.
+func TestShutdownDrainsJobs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 100*time.Millisecond)))
+	defer ts.Close()
+	delivered := make(chan struct{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer callback.Close()
+
+	d := newDrainer()
+	u, _ := url.Parse(callback.URL)
+	store := newJobStore(10, time.Hour, []string{u.Host})
+	server, serverURL := startDrainServer(t, d, createJobsHandler(newTestPipeline(t, withURLs(ts.URL)), store, d))
+	resp, err := http.Post(serverURL+"/jobs?callback="+url.QueryEscape(callback.URL), "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	summary := shutdown(server, d, 0, time.Second)
+	select {
+	case <-delivered:
+	default:
+		t.Error("the manager shut down before the job's callback was called")
+	}
+	if summary.jobs != 1 || summary.dropped != 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestReadyzWhileDraining(t *testing.T) {
+	d := newDrainer()
+	d.start()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	createReadyzHandler(newTestPipeline(t), d)(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("a draining manager got status %d from /readyz", w.Code)
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many events a tap holds for a slow client before it starts
+// dropping them. Taps never hold up the pipeline.
+const tapBuffer = 64
+
+// A copy of what a stage was sent and what it passed on.
+type tapEvent struct {
+	ID      string          `json:"id"`
+	Bundle  string          `json:"bundle"`
+	Time    time.Time       `json:"time"`
+	Elapsed float64         `json:"elapsed"` // milliseconds
+	Skipped bool            `json:"skipped,omitempty"`
+	Input   json.RawMessage `json:"input"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Records aren't always JSON; those that aren't are kept as strings.
+func rawRecord(record []byte) json.RawMessage {
+	if record == nil {
+		return nil
+	}
+	if json.Valid(record) {
+		return record
+	}
+	quoted, _ := json.Marshal(string(record))
+	return quoted
+}
+
+type tap struct {
+	events chan *tapEvent
+	sample float64
+}
+
+// The taps on every stage, by pipeline and bundle. Like the metrics,
+// taps outlive reloads of the pipeline.
+type tapRegistry struct {
+	sync.Mutex
+	count int32 // so publishing is cheap when nobody is listening
+	taps  map[stageKey]map[*tap]bool
+}
+
+var taps = &tapRegistry{taps: make(map[stageKey]map[*tap]bool)}
+
+func (r *tapRegistry) subscribe(pipeline, bundle string, sample float64) *tap {
+	r.Lock()
+	defer r.Unlock()
+	key := stageKey{pipeline, bundle}
+	if r.taps[key] == nil {
+		r.taps[key] = make(map[*tap]bool)
+	}
+	t := &tap{events: make(chan *tapEvent, tapBuffer), sample: sample}
+	r.taps[key][t] = true
+	atomic.AddInt32(&r.count, 1)
+	return t
+}
+
+func (r *tapRegistry) unsubscribe(pipeline, bundle string, t *tap) {
+	r.Lock()
+	defer r.Unlock()
+	key := stageKey{pipeline, bundle}
+	delete(r.taps[key], t)
+	if len(r.taps[key]) == 0 {
+		delete(r.taps, key)
+	}
+	atomic.AddInt32(&r.count, -1)
+}
+
+// Sends the event to every tap on the stage that samples it. The event
+// is only built if some tap wants it.
+func (r *tapRegistry) publish(pipeline, bundle string, event func() *tapEvent) {
+	if atomic.LoadInt32(&r.count) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	var e *tapEvent
+	for t := range r.taps[stageKey{pipeline, bundle}] {
+		if t.sample < 1 && rand.Float64() >= t.sample {
+			continue
+		}
+		if e == nil {
+			e = event()
+		}
+		select {
+		case t.events <- e:
+		default:
+		}
+	}
+}
+
+// Streams a sample of the records going through a stage as server-sent
+// events, until the client goes away or the manager shuts down.
+func createTapHandler(source pipelineSource, drain *drainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		p := source.current()
+		bundle := r.URL.Query().Get("bundle")
+		if p.stage(bundle) == nil {
+			writeError(w, &requestError{http.StatusNotFound, fmt.Sprintf("There is no bundle named '%s'.", bundle)})
+			return
+		}
+		sample := 1.0
+		if s := r.URL.Query().Get("sample"); s != "" {
+			var err error
+			if sample, err = strconv.ParseFloat(s, 64); err != nil || sample <= 0 || sample > 1 {
+				writeError(w, &requestError{http.StatusBadRequest, "'sample' must be a number greater than 0 and at most 1."})
+				return
+			}
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, &requestError{http.StatusInternalServerError, "Streaming is not supported."})
+			return
+		}
+
+		t := taps.subscribe(p.Name, bundle, sample)
+		defer taps.unsubscribe(p.Name, bundle, t)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, ": tapping '%s'\n\n", bundle)
+		flusher.Flush()
+		for {
+			select {
+			case e := <-t.events:
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: record\ndata: %s\n\n", data); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-drain.done():
+				// taps never end on their own, so they'd hold up
+				// shutting down
+				return
+			}
+		}
+	}
+}
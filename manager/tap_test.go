@@ -0,0 +1,95 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTap(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(makeEnhancer("a", 0)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeEnhancer("b", 0)))
+	defer b.Close()
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "tap", "stages": [
+		{"name": "a", "url": "%s"}, {"name": "b", "url": "%s", "depends": ["a"]}]}`, a.URL, b.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(createTapHandler(p, nil)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/tap?bundle=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("tap has content type '%s'", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	// once we've read the greeting, we're subscribed
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, ": tapping") {
+		t.Fatalf("unexpected greeting '%s'", line)
+	}
+	reader.ReadString('\n')
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"x": 1}`))
+	req.Header.Set(requestIDHeader, "tapped")
+	createHandler(p)(httptest.NewRecorder(), req)
+
+	if line, _ := reader.ReadString('\n'); line != "event: record\n" {
+		t.Fatalf("unexpected event '%s'", line)
+	}
+	line, _ := reader.ReadString('\n')
+	var e tapEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "tapped" || e.Bundle != "b" || e.Error != "" ||
+		string(e.Input) != `{"a":"a saw 1 fields","x":1}` ||
+		string(e.Output) != `{"a":"a saw 1 fields","b":"b saw 2 fields","x":1}` {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestTapErrors(t *testing.T) {
+	handler := createTapHandler(newTestPipeline(t, withURLs("http://a:9800")), nil)
+	for query, status := range map[string]int{
+		"bundle=nope":                    http.StatusNotFound,
+		"bundle=http://a:9800&sample=2":  http.StatusBadRequest,
+		"bundle=http://a:9800&sample=no": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", "/tap?"+query, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != status {
+			t.Errorf("'%s' got status %d, expected %d", query, w.Code, status)
+		}
+	}
+}
+
+func TestTapRecord(t *testing.T) {
+	if string(rawRecord([]byte(`{"a": 1}`))) != `{"a": 1}` || string(rawRecord([]byte(`nope`))) != `"nope"` || rawRecord(nil) != nil {
+		t.Error("rawRecord did not keep JSON and quote everything else")
+	}
+}
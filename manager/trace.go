@@ -0,0 +1,176 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const serverTimingHeader = "Server-Timing"
+
+const skippedHeader = "X-Plumber-Skipped"
+
+// What happened to a single record on its way through the pipeline.
+// Every enhancer is sent the record's id, so their logs can be matched
+// up with the manager's response.
+type trace struct {
+	sync.Mutex
+	id      string
+	start   time.Time
+	timings []stageTiming
+	skipped []string // bundles the record skipped because it was missing an input
+	replay  bool     // true if the record is a replay of recorded traffic
+	// the id of the dead letter the record was stored as, if it failed
+	deadLetter string
+}
+
+type stageTiming struct {
+	bundle  string
+	elapsed time.Duration
+}
+
+func newTrace(id string) *trace {
+	return &trace{id: id, start: time.Now()}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Use the caller's request id if they sent one, so requests can be
+// followed across services.
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(requestIDHeader)); id != "" {
+		return id
+	}
+	return newRequestID()
+}
+
+// Records how long a bundle took, including any retries. A nil trace
+// ignores it.
+func (t *trace) observe(bundle string, elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.timings = append(t.timings, stageTiming{bundle, elapsed})
+}
+
+// Records that the record skipped a bundle. A nil trace ignores it.
+func (t *trace) skip(bundle string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.skipped = append(t.skipped, bundle)
+}
+
+// Records that the record was stored as a dead letter. A nil trace
+// ignores it.
+func (t *trace) storedAs(id string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.deadLetter = id
+}
+
+// The bundles the record skipped, in the order it skipped them.
+func (t *trace) skippedBundles() []string {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return append([]string(nil), t.skipped...)
+}
+
+func (t *trace) isReplay() bool {
+	return t != nil && t.replay
+}
+
+func (t *trace) requestID() string {
+	if t == nil {
+		return ""
+	}
+	return t.id
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 127 || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// The per-bundle latencies in the format of the `Server-Timing` header,
+// in the order the bundles finished, followed by the total. Bundle
+// names that aren't valid metric names (such as urls) are put in the
+// description instead.
+func (t *trace) serverTiming() string {
+	t.Lock()
+	defer t.Unlock()
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+	}
+	metrics := make([]string, 0, len(t.timings)+1)
+	for i, timing := range t.timings {
+		if isToken(timing.bundle) {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%s", timing.bundle, ms(timing.elapsed)))
+		} else {
+			desc := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(timing.bundle)
+			metrics = append(metrics, fmt.Sprintf(`stage%d;desc="%s";dur=%s`, i, desc, ms(timing.elapsed)))
+		}
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%s", ms(time.Since(t.start))))
+	return strings.Join(metrics, ", ")
+}
+
+// Sets the request id and timing headers on the response, and lists
+// the bundles the record skipped and the dead letter it was stored as,
+// if any.
+func (t *trace) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set(requestIDHeader, t.id)
+	w.Header().Set(serverTimingHeader, t.serverTiming())
+	t.Lock()
+	defer t.Unlock()
+	if len(t.skipped) > 0 {
+		w.Header().Set(skippedHeader, strings.Join(t.skipped, ", "))
+	}
+	if t.deadLetter != "" {
+		w.Header().Set(deadLetterHeader, t.deadLetter)
+	}
+}
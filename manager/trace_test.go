@@ -0,0 +1,117 @@
+/**
+ * Copyright 2015 Qadium, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An enhancer that remembers the request ids it was sent.
+func makeIDEnhancer(mutex *sync.Mutex, ids *[]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		*ids = append(*ids, r.Header.Get(requestIDHeader))
+		mutex.Unlock()
+		w.Write([]byte(`{}`))
+	}
+}
+
+func TestRequestIDIsForwarded(t *testing.T) {
+	var mutex sync.Mutex
+	ids := []string{}
+	a := httptest.NewServer(http.HandlerFunc(makeIDEnhancer(&mutex, &ids)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(makeIDEnhancer(&mutex, &ids)))
+	defer b.Close()
+	handler := createHandler(newTestPipeline(t, withURLs(a.URL, b.URL)))
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	req.Header.Set(requestIDHeader, "abc123")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Header().Get(requestIDHeader) != "abc123" {
+		t.Errorf("response had request id '%s'", w.Header().Get(requestIDHeader))
+	}
+	if len(ids) != 2 || ids[0] != "abc123" || ids[1] != "abc123" {
+		t.Errorf("enhancers were sent request ids %v", ids)
+	}
+
+	// without an id, the manager makes one up
+	ids = ids[:0]
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	id := w.Header().Get(requestIDHeader)
+	if id == "" || len(ids) != 2 || ids[0] != id {
+		t.Errorf("response had request id '%s' but enhancers were sent %v", id, ids)
+	}
+}
+
+func TestBatchRequestIDs(t *testing.T) {
+	var mutex sync.Mutex
+	ids := []string{}
+	enhancer := httptest.NewServer(http.HandlerFunc(makeIDEnhancer(&mutex, &ids)))
+	defer enhancer.Close()
+	handler := createBatchHandler(newTestPipeline(t, withURLs(enhancer.URL)))
+
+	req, _ := http.NewRequest("POST", "/batch", strings.NewReader(`[{}, {}, {}]`))
+	req.Header.Set(requestIDHeader, "batch")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != "[batch-0 batch-1 batch-2]" {
+		t.Errorf("enhancers were sent request ids %v", ids)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(makeEnhancer("slow", 20*time.Millisecond)))
+	defer slow.Close()
+	p, err := parsePipeline([]byte(fmt.Sprintf(`{"name": "foo", "stages": [{"name": "slow", "url": "%s"}]}`, slow.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	createHandler(p)(w, req)
+
+	timing := w.Header().Get(serverTimingHeader)
+	match := regexp.MustCompile(`^slow;dur=([0-9.]+), total;dur=[0-9.]+$`).FindStringSubmatch(timing)
+	if match == nil {
+		t.Fatalf("unexpected Server-Timing header '%s'", timing)
+	}
+	var ms float64
+	fmt.Sscan(match[1], &ms)
+	if ms < 20 {
+		t.Errorf("slow stage took %gms; expected at least 20ms", ms)
+	}
+
+	// urls aren't valid metric names
+	tr := newTrace("id")
+	tr.observe("http://host:9800", time.Millisecond)
+	if !strings.HasPrefix(tr.serverTiming(), `stage0;desc="http://host:9800";dur=1.0, total;dur=`) {
+		t.Errorf("unexpected Server-Timing header '%s'", tr.serverTiming())
+	}
+}